@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
 	"math"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
+	"strings"
 )
 
 type Site struct {
@@ -28,6 +32,7 @@ type Site struct {
 type Sites map[int]*Site
 
 type Unit struct {
+	ID       int
 	position Position
 	health   int
 	owner    int
@@ -53,6 +58,24 @@ type Game struct {
 	enemyTowers                     Sites
 	unitBuildQueue                  []int
 	strategy                        int
+	buildTarget                     *BuildCandidate
+	limits                          Limits
+	phase                           int
+	endgameMode                     int
+	enemyQueenStartingPosition      Position
+	opponent                        *OpponentModel
+	threats                         []Threat
+	mirrored                        bool
+	tracker                         *UnitTracker
+	giantPlan                       *GiantPlan
+	enemyIntent                     *EnemyQueenIntent
+	relocation                      *Relocation
+	approachPoints                  []Position
+	contestedSites                  map[int]ContestedSite
+	events                          *EventBus
+	knightPressure                  []int
+	defenseMode                     bool
+	input                           io.Reader
 }
 
 type Position struct {
@@ -60,6 +83,268 @@ type Position struct {
 	y int
 }
 
+// Limits How many of each structure and unit we want at most, see getLimits
+type Limits struct {
+	knightBarracks int
+	giantBarracks  int
+	archerBarracks int
+	goldMines      int
+	towers         int
+	knights        int
+	archers        int
+	giants         int
+}
+
+// Threat An enemy unit, what it's going for, when it gets there and how much damage it can do
+type Threat struct {
+	unit          Unit
+	target        int
+	targetSiteID  int
+	turnsToImpact int
+	damage        int
+}
+
+// OpponentModel What we've seen the enemy do so far, see observe and classify
+type OpponentModel struct {
+	turnsObserved       int
+	maxTowers           int
+	maxGoldMines        int
+	maxKnightBarracks   int
+	maxGiantBarracks    int
+	maxArcherBarracks   int
+	firstBarracksTurn   int
+	unitTurnsSeen       UnitCount
+	queenTurnsInOurHalf int
+	queenPositionTotal  Position
+	label               int
+	confidence          float64
+}
+
+// Simulation A forward model of the units and towers, see newSimulation
+type Simulation struct {
+	turn   int
+	queens map[int]Unit
+	units  []Unit
+	towers []Site
+	result Prediction
+}
+
+// Prediction What the forward model expects to happen
+type Prediction struct {
+	turns               int
+	units               []Unit
+	deaths              []UnitDeath
+	queenDamage         map[int]int
+	structureDamage     map[int]int
+	destroyedStructures []int
+}
+
+type UnitDeath struct {
+	unit Unit
+	turn int
+}
+
+// UnitTracker Follows units from turn to turn, see update
+type UnitTracker struct {
+	nextID int
+	units  map[int]*TrackedUnit
+}
+
+// TrackedUnit A unit we've been following since it spawned
+type TrackedUnit struct {
+	unit          Unit
+	spawnTurn     int
+	lastSeenTurn  int
+	healthHistory []int
+}
+
+// GiantPlan Which enemy towers the Giant goes for, where it's trained, and when its Knight escort follows
+type GiantPlan struct {
+	targetIDs        []int
+	barracksSiteID   int
+	knightDelay      int
+	worthIt          bool
+	giantTrainedTurn int
+	escortQueued     bool
+}
+
+// KnightWave How many Knights we train together, from how many barracks, for how much gold
+type KnightWave struct {
+	knights int
+	batches int
+	gold    int
+}
+
+// Relocation Moving a Knight barracks to a better site: build the new one first, then replace the old one
+type Relocation struct {
+	fromSiteID int
+	toSiteID   int
+}
+
+// ContestedSite A midfield site both queens can reach at about the same time, and what we do about it
+type ContestedSite struct {
+	myArrival    int
+	enemyArrival int
+	canHold      bool
+	claimAs      int
+}
+
+// EnemyQueenIntent Where the enemy queen has been, where she's going and what she'll build there, see update
+type EnemyQueenIntent struct {
+	trajectory      []Position
+	targetSiteID    int
+	likelyStructure int
+	builtStructures map[int]int
+}
+
+// EventBus Diffs consecutive turns into Events and hands them to the subscribers, see diff
+type EventBus struct {
+	subscribers    map[int][]func(Event)
+	previousSites  map[int]Site
+	previousUnits  map[int]Unit
+	previousQueens map[int]Unit
+}
+
+// Event Something that changed since last turn. Which fields are set depends on the eventType.
+type Event struct {
+	eventType     int
+	turn          int
+	siteID        int
+	owner         int
+	structureType int
+	unit          Unit
+	amount        int
+}
+
+// GameSnapshot The game state of a turn, as JSON. Positions are in our (left side) frame, see setFrame.
+type GameSnapshot struct {
+	Turn                       int              `json:"turn"`
+	Gold                       int              `json:"gold"`
+	TouchedSite                int              `json:"touchedSite"`
+	Strategy                   int              `json:"strategy"`
+	Phase                      int              `json:"phase"`
+	Mirrored                   bool             `json:"mirrored"`
+	StartingHealth             int              `json:"startingHealth"`
+	MyQueenStartingPosition    PositionSnapshot `json:"myQueenStartingPosition"`
+	EnemyQueenStartingPosition PositionSnapshot `json:"enemyQueenStartingPosition"`
+	NumberOfTowers             int              `json:"numberOfTowers"`
+	NumberOfBarracks           map[int]int      `json:"numberOfBarracks"`
+	UnitBuildQueue             []int            `json:"unitBuildQueue"`
+	MyQueen                    UnitSnapshot     `json:"myQueen"`
+	EnemyQueen                 UnitSnapshot     `json:"enemyQueen"`
+	Units                      []UnitSnapshot   `json:"units"`
+	Sites                      []SiteSnapshot   `json:"sites"`
+
+	// What we remember from earlier turns, left out of puzzles that start fresh
+	DefenseMode    bool                 `json:"defenseMode,omitempty"`
+	KnightPressure []int                `json:"knightPressure,omitempty"`
+	BuildTarget    *BuildTargetSnapshot `json:"buildTarget,omitempty"`
+	Opponent       *OpponentSnapshot    `json:"opponent,omitempty"`
+	GiantPlan      *GiantPlanSnapshot   `json:"giantPlan,omitempty"`
+	Relocation     *RelocationSnapshot  `json:"relocation,omitempty"`
+	Tracker        *TrackerSnapshot     `json:"tracker,omitempty"`
+	EnemyIntent    *IntentSnapshot      `json:"enemyIntent,omitempty"`
+}
+
+type BuildTargetSnapshot struct {
+	SiteID        int     `json:"siteId"`
+	StructureType int     `json:"structureType"`
+	Score         float64 `json:"score"`
+}
+
+type OpponentSnapshot struct {
+	TurnsObserved       int              `json:"turnsObserved"`
+	MaxTowers           int              `json:"maxTowers"`
+	MaxGoldMines        int              `json:"maxGoldMines"`
+	MaxKnightBarracks   int              `json:"maxKnightBarracks"`
+	MaxGiantBarracks    int              `json:"maxGiantBarracks"`
+	MaxArcherBarracks   int              `json:"maxArcherBarracks"`
+	FirstBarracksTurn   int              `json:"firstBarracksTurn"`
+	UnitTurnsSeen       map[int]int      `json:"unitTurnsSeen"`
+	QueenTurnsInOurHalf int              `json:"queenTurnsInOurHalf"`
+	QueenPositionTotal  PositionSnapshot `json:"queenPositionTotal"`
+	Label               int              `json:"label"`
+	Confidence          float64          `json:"confidence"`
+}
+
+type GiantPlanSnapshot struct {
+	TargetIDs        []int `json:"targetIds"`
+	BarracksSiteID   int   `json:"barracksSiteId"`
+	KnightDelay      int   `json:"knightDelay"`
+	WorthIt          bool  `json:"worthIt"`
+	GiantTrainedTurn int   `json:"giantTrainedTurn"`
+	EscortQueued     bool  `json:"escortQueued"`
+}
+
+type RelocationSnapshot struct {
+	FromSiteID int `json:"fromSiteId"`
+	ToSiteID   int `json:"toSiteId"`
+}
+
+type TrackerSnapshot struct {
+	NextID int                   `json:"nextId"`
+	Units  []TrackedUnitSnapshot `json:"units"`
+}
+
+type TrackedUnitSnapshot struct {
+	Unit          UnitSnapshot `json:"unit"`
+	SpawnTurn     int          `json:"spawnTurn"`
+	LastSeenTurn  int          `json:"lastSeenTurn"`
+	HealthHistory []int        `json:"healthHistory"`
+}
+
+type IntentSnapshot struct {
+	Trajectory      []PositionSnapshot `json:"trajectory"`
+	TargetSiteID    int                `json:"targetSiteId"`
+	LikelyStructure int                `json:"likelyStructure"`
+	BuiltStructures map[int]int        `json:"builtStructures"`
+}
+
+// Puzzle A position to play, and what we expect the bot to do in it. Expectations are in our (left side) frame,
+// just like the snapshot. Every puzzle is also played from the other side of the field, where the actions have to
+// come out mirrored.
+type Puzzle struct {
+	Name     string             `json:"name"`
+	Snapshot GameSnapshot       `json:"snapshot"`
+	Expect   PuzzleExpectations `json:"expect"`
+}
+
+type PuzzleExpectations struct {
+	QueenAction       string `json:"queenAction,omitempty"`
+	TrainAction       string `json:"trainAction,omitempty"`
+	Builds            string `json:"builds,omitempty"`
+	BuildSite         *int   `json:"buildSite,omitempty"`
+	MovesTowardSite   *int   `json:"movesTowardSite,omitempty"`
+	AvoidsEnemyTowers bool   `json:"avoidsEnemyTowers,omitempty"`
+}
+
+type PositionSnapshot struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+type UnitSnapshot struct {
+	ID       int `json:"id,omitempty"`
+	X        int `json:"x"`
+	Y        int `json:"y"`
+	Health   int `json:"health"`
+	Owner    int `json:"owner"`
+	UnitType int `json:"unitType"`
+}
+
+type SiteSnapshot struct {
+	ID            int `json:"id"`
+	X             int `json:"x"`
+	Y             int `json:"y"`
+	Radius        int `json:"radius"`
+	StructureType int `json:"structureType"`
+	Owner         int `json:"owner"`
+	Param1        int `json:"param1"`
+	Param2        int `json:"param2"`
+	GoldRemaining int `json:"goldRemaining"`
+	MaxMineSize   int `json:"maxMineSize"`
+}
+
 type BarracksCount map[int]int
 type UnitCount map[int]int
 
@@ -67,8 +352,8 @@ type UnitCount map[int]int
 Configurable values
 *************************************************/
 
-// MaxKnightBarracks How many Knight Barracks do we build?
-const MaxKnightBarracks = 1
+// MaxKnightBarracks How many Knight Barracks do we build? More than one lets a Knight wave spawn together.
+const MaxKnightBarracks = 2
 
 // MaxGoldMines How many Gold mines should we have?
 const MaxGoldMines = 3
@@ -85,12 +370,33 @@ const MaxKnights = 12
 // MaxArcher How many Archers do we want to have at one time?
 const MaxArcher = 4
 
+// MaxGiantBarracks How many Giant Barracks should we build? (only when a strategy asks for Giants)
+const MaxGiantBarracks = 1
+
+// MaxGiants How many Giants do we want to have at one time?
+const MaxGiants = 2
+
+// SnapshotTurn Dump the game state of this turn as JSON, 0 to only dump it when a turn panics
+const SnapshotTurn = 0
+
 // MinTowerRangeConstruction Until what range should we "grow" our towers?
 const MinTowerRangeConstruction = 400
 
 // IgnoreGoldmine Change this goldmine into a Tower, if gold remaining is less than this.
 const IgnoreGoldmine = 10
 
+// OpeningTurns How long is the opening at most?
+const OpeningTurns = 30
+
+// EndGameTurns How many turns before MaxTurns does the endgame start?
+const EndGameTurns = 40
+
+// EndGameMineGold The endgame starts when less than this gold is left in all mines together.
+const EndGameMineGold = 500
+
+// MidGameArmySize The mid-game starts when there are this many units on the field.
+const MidGameArmySize = 8
+
 // Layered sites constants
 
 /************************************************
@@ -124,6 +430,69 @@ const KnightCost = 80
 const ArcherCost = 100
 const GiantCost = 140
 
+/************************************************
+Units per training
+*************************************************/
+
+const KnightsPerTraining = 4
+const ArchersPerTraining = 2
+const GiantsPerTraining = 1
+
+/************************************************
+Unit Stats
+*************************************************/
+
+const QueenSpeed = 60
+const KnightSpeed = 100
+const ArcherSpeed = 75
+const GiantSpeed = 50
+
+const QueenRadius = 30
+const KnightRadius = 20
+const ArcherRadius = 25
+const GiantRadius = 40
+
+// KnightDamage Damage a Knight does to the queen every turn it's in contact
+const KnightDamage = 1
+
+// ArcherDamage Damage an Archer does to a unit in range every turn
+const ArcherDamage = 2
+
+// ArcherRange How far an Archer can shoot
+const ArcherRange = 200
+
+// ArcherGiantDamage Damage an Archer does to a Giant every turn
+const ArcherGiantDamage = 10
+
+// GiantDamage Health a Tower loses to a Giant every turn the Giant is in contact with it
+const GiantDamage = 80
+
+// KnightHealth Health of a freshly trained Knight
+const KnightHealth = 30
+
+// ArcherHealth Health of a freshly trained Archer
+const ArcherHealth = 45
+
+// KnightTrainTurns How many turns it takes to train Knights, and the same for the others
+const KnightTrainTurns = 5
+const ArcherTrainTurns = 8
+const GiantTrainTurns = 10
+
+// UnitDecay Health every unit (except the queens) loses every turn
+const UnitDecay = 1
+
+// TowerMeltRate Health a Tower loses every turn
+const TowerMeltRate = 4
+
+// TowerCoveragePerHP Area a Tower covers per health point, on top of the site itself
+const TowerCoveragePerHP = 1000
+
+// TowerQueenDamage Minimum damage a Tower does to a queen in range, it goes up by 1 for every 200 px closer to the tower.
+const TowerQueenDamage = 1
+
+// TowerCreepDamage Minimum damage a Tower does to a unit in range, it goes up by 1 for every 200 px closer to the tower.
+const TowerCreepDamage = 3
+
 /************************************************
 Owner Constants
 *************************************************/
@@ -139,18 +508,213 @@ Field Settings
 const FieldWidth = 1920
 const FieldHeight = 1000
 
+// MaxTurns After this many turns the queen with the most health wins
+const MaxTurns = 200
+
 /************************************************
 Strategy
 *************************************************/
 
 const DefaultStrategy = 0
 const TooManyTowersStrategy = 1
+const RushDefenseStrategy = 2
+
+/************************************************
+Threat Targets
+*************************************************/
+
+const QueenTarget = 0
+const StructureTarget = 1
+const UnitTarget = 2
+
+// GiantHealth Health of a freshly trained Giant
+const GiantHealth = 200
+
+// GiantPushTowerValue How much gold is taking out an enemy tower worth to us?
+const GiantPushTowerValue = 150
+
+// MineIncome Gold a fresh mine makes every turn
+const MineIncome = 1
+
+// DefensePressureTurns Over how many turns do we average the enemy Knights on our half?
+const DefensePressureTurns = 10
+
+// DefenseEnterKnights Start the archer defense when on average this many enemy Knights are on our half
+const DefenseEnterKnights = 3.0
+
+// DefenseExitKnights Stop the archer defense when on average less than this many enemy Knights are on our half
+const DefenseExitKnights = 1.0
+
+// KnightsPerArcher How many enemy Knights can one Archer handle?
+const KnightsPerArcher = 2
+
+// QueenTurnValue What a turn of the queen standing still is worth, in gold
+const QueenTurnValue = 10
+
+// QueenHealthValue What a point of queen health is worth, in gold
+const QueenHealthValue = 5
+
+// SabotageBarracksValue What taking an enemy barracks is worth, in gold
+const SabotageBarracksValue = 150
+
+// UnknownMineGold The gold we assume is left in a mine we haven't seen the gold of
+const UnknownMineGold = 200
+
+// ContestedTurns Sites both queens reach within this many turns of each other are contested
+const ContestedTurns = 3
+
+// ContestedMidfield Only sites within this distance of the center line are contested
+const ContestedMidfield = 400
+
+// SkipSite Don't claim a contested site
+const SkipSite = -1
+
+// IntentHistory How many turns of the enemy queen's trajectory we keep
+const IntentHistory = 20
+
+// IntentMinAlignment How closely does the enemy queen have to move towards a site before we think she's going there?
+const IntentMinAlignment = 0.8
+
+// ApproachPointStep Distance between the points we sample on the enemy's approach lanes
+const ApproachPointStep = 50
+
+// TowerCoverageScore Score of a Tower covering every approach point that isn't covered yet
+const TowerCoverageScore = 80.0
+
+// RelocateMargin How much better does a new site have to be before we move a Knight barracks?
+// Placement scores are in steps of 50, so this is about 300 closer to the enemy, after the queen's travel.
+const RelocateMargin = 6.0
+
+// RelocateTravelCost Score lost per distance the queen travels to the new site, in the same steps as the placement score
+const RelocateTravelCost = 50.0
+
+// WaveSurvivors How many Knights of a wave should make it past the enemy towers to the enemy queen?
+const WaveSurvivors = 3
+
+// ThreatHorizon How many turns ahead does the queen react to incoming Knights?
+const ThreatHorizon = 4
+
+// SafeZoneGridStep Distance between the positions the safe zone search tries
+const SafeZoneGridStep = 100
+
+// SafeZoneEnemyDistance Being further away from enemy units than this doesn't make a position any safer
+const SafeZoneEnemyDistance = 600
+
+// EvasionTurns How many turns ahead does the evasion planner simulate the Knights chasing the queen?
+const EvasionTurns = 5
+
+// EvasionDirections How many directions does the evasion planner try?
+const EvasionDirections = 16
+
+// RetreatThreatDamage Retreat when the Knights arriving within the horizon can do this much damage (about 3 Knights)
+const RetreatThreatDamage = 60
+
+/************************************************
+Event Types
+*************************************************/
+
+const AllEvents = -1
+const SiteClaimedEvent = 0
+const SiteLostEvent = 1
+const StructureBuiltEvent = 2
+const StructureDestroyedEvent = 3
+const StructureUpgradedEvent = 4
+const UnitSpawnedEvent = 5
+const UnitDiedEvent = 6
+const QueenDamagedEvent = 7
+const MineDepletedEvent = 8
+
+// NoStructure The structure type of an empty site
+const NoStructure = -1
+
+/************************************************
+Opponent Types
+*************************************************/
+
+const UnknownOpponent = 0
+const KnightRushOpponent = 1
+const TowerTurtleOpponent = 2
+const GiantPushOpponent = 3
+const ArcherDefenseOpponent = 4
+const MineGreedOpponent = 5
+
+// OpponentConfidence How sure do we need to be about the opponent before we counter it?
+const OpponentConfidence = 0.6
+
+// RushConfidence An early Knight barracks and some Knights is just a normal opening, a rush also sends its queen over
+const RushConfidence = 0.85
+
+// TurtleExtraTowers A turtle has this many more Towers than we'd ever build, see MaxTowers
+const TurtleExtraTowers = 3.0
+
+// EarlyBarracksTurn A Knight barracks before this turn is a rush
+const EarlyBarracksTurn = 40
+
+/************************************************
+Game Phases
+*************************************************/
+
+const OpeningPhase = 0
+const ExpansionPhase = 1
+const MidGamePhase = 2
+const EndGamePhase = 3
+
+/************************************************
+Endgame Modes
+*************************************************/
+
+const NoEndgameMode = 0
+const PreserveHealthMode = 1
+const PressureQueenMode = 2
+
+// TiebreakTurns In the last turns the game is decided on queen health, see determineEndgameMode
+const TiebreakTurns = 25
+
+// TiebreakMargin How much health we want to be ahead before we stop pressuring the enemy queen
+const TiebreakMargin = 5
 
 /************************************************
 MAIN FUNCTION
 *************************************************/
 func main() {
-	game := Game{
+	if len(os.Args) > 1 && os.Args[1] == "puzzles" {
+		// go run . puzzles [directory]
+		directory := "puzzles"
+		if len(os.Args) > 2 {
+			directory = os.Args[2]
+		}
+		if !runPuzzles(directory) {
+			os.Exit(1)
+		}
+		return
+	}
+	if len(os.Args) > 2 && os.Args[1] == "replay" {
+		// go run . replay snapshot.json, plays a dumped turn again
+		if !replaySnapshot(os.Args[2]) {
+			os.Exit(1)
+		}
+		return
+	}
+
+	game := newGame()
+	game.readSites()
+	for {
+		game.readTurn()
+		snapshot := game.snapshot()
+		if game.turn == SnapshotTurn {
+			fmt.Fprintln(os.Stderr, "Snapshot:", snapshot.toJSON())
+		}
+
+		queenAction, trainAction := game.playTurn(snapshot)
+		fmt.Println(queenAction)
+		fmt.Println(trainAction)
+		game.turn++
+		fmt.Fprintln(os.Stderr, "There are", len(game.enemyTowers), "enemyTowers")
+	}
+}
+
+func newGame() *Game {
+	game := &Game{
 		numberOfBarracks: &BarracksCount{
 			Knight: 0,
 			Archer: 0,
@@ -168,64 +732,132 @@ func main() {
 		sites:           nil,
 		turn:            1,
 		strategy:        DefaultStrategy,
+		phase:           OpeningPhase,
+		opponent: &OpponentModel{
+			unitTurnsSeen: UnitCount{},
+		},
+		tracker: &UnitTracker{
+			units: map[int]*TrackedUnit{},
+		},
+		events: &EventBus{
+			subscribers:    map[int][]func(Event){},
+			previousSites:  map[int]Site{},
+			previousUnits:  map[int]Unit{},
+			previousQueens: map[int]Unit{},
+		},
+		enemyIntent: &EnemyQueenIntent{
+			targetSiteID:    -1,
+			builtStructures: map[int]int{},
+		},
+		input: os.Stdin,
 	}
 
+	game.events.subscribe(StructureBuiltEvent, game.countBuiltStructure)
+	game.events.subscribe(StructureDestroyedEvent, game.countDestroyedStructure)
+	game.events.subscribe(StructureBuiltEvent, game.enemyIntent.recordBuilt)
+	game.events.subscribe(AllEvents, logEvent)
+	return game
+}
+
+func (game *Game) readSites() {
 	var numSites int
-	fmt.Scan(&numSites)
+	fmt.Fscan(game.input, &numSites)
 	game.sites = make(Sites)
 	for i := 0; i < numSites; i++ {
 		site := &Site{}
-		fmt.Scan(&site.ID, &site.position.x, &site.position.y, &site.radius)
+		fmt.Fscan(game.input, &site.ID, &site.position.x, &site.position.y, &site.radius)
 		site.owner = Neutral // Default no owner
 		game.sites[site.ID] = site
 		//game.sites[site.ID].distanceFromStartingLocation = distanceBetween(game.sites[site.ID].position, )
 		fmt.Fprintln(os.Stderr, site.ID, site.position.x, site.position.y, site.radius)
 	}
-	for {
-		fmt.Scan(&game.gold, &game.touchedSite)
-
-		for i := 0; i < numSites; i++ {
-			var siteID, goldRemaining, maxMineSize, structureType, owner, param1, param2 int
-			fmt.Scan(&siteID, &goldRemaining, &maxMineSize, &structureType, &owner, &param1, &param2)
-			game.changeSite(siteID, structureType, owner, param1, param2, goldRemaining, maxMineSize)
-			//fmt.Fprintln(os.Stderr, siteID, "maxsize", maxMineSize, goldRemaining)
-		}
-		var numUnits int
-		game.myUnits = []Unit{}
-		game.enemyUnits = []Unit{}
-		game.numberOfMyUnits = UnitCount{
-			Knight: 0,
-			Archer: 0,
-			Giant:  0,
-		}
-		fmt.Scan(&numUnits)
-		for i := 0; i < numUnits; i++ {
-			var x, y, owner, unitType, health int
-			fmt.Scan(&x, &y, &owner, &unitType, &health)
-			game.buildUnit(x, y, owner, unitType, health)
+}
+
+// readTurn Reads the turn's input, and keeps everything that follows straight from it up to date
+func (game *Game) readTurn() {
+	fmt.Fscan(game.input, &game.gold, &game.touchedSite)
+
+	for i := 0; i < len(game.sites); i++ {
+		var siteID, goldRemaining, maxMineSize, structureType, owner, param1, param2 int
+		fmt.Fscan(game.input, &siteID, &goldRemaining, &maxMineSize, &structureType, &owner, &param1, &param2)
+		game.changeSite(siteID, structureType, owner, param1, param2, goldRemaining, maxMineSize)
+		//fmt.Fprintln(os.Stderr, siteID, "maxsize", maxMineSize, goldRemaining)
+	}
+	var numUnits int
+	game.myUnits = []Unit{}
+	game.enemyUnits = []Unit{}
+	game.numberOfMyUnits = UnitCount{
+		Knight: 0,
+		Archer: 0,
+		Giant:  0,
+	}
+	fmt.Fscan(game.input, &numUnits)
+	units := make([][5]int, numUnits)
+	for i := 0; i < numUnits; i++ {
+		fmt.Fscan(game.input, &units[i][0], &units[i][1], &units[i][2], &units[i][3], &units[i][4])
+	}
+	if game.turn == 1 {
+		game.setFrame(units)
+	}
+	for _, unit := range units {
+		position := game.toLocal(Position{x: unit[0], y: unit[1]})
+		game.buildUnit(position.x, position.y, unit[2], unit[3], unit[4])
+	}
+	if game.turn == 1 {
+		game.myQueenStartingPosition = Position{
+			x: game.myQueen.position.x,
+			y: game.myQueen.position.y,
 		}
-		if game.turn == 1 {
-			game.myQueenStartingPosition = Position{
-				x: game.myQueen.position.x,
-				y: game.myQueen.position.y,
-			}
-			game.startingHealth = game.myQueen.health
-			game.setSitesOrderedByDistanceFromStart()
+		game.enemyQueenStartingPosition = game.enemyQueen.position
+		game.startingHealth = game.myQueen.health
+		game.setSitesOrderedByDistanceFromStart()
+	}
+	game.sites.setDistancesFromQueens(game.myQueen, game.enemyQueen)
+	game.tracker.update(game.turn, game.myUnits, game.enemyUnits)
+	game.events.diff(game)
+	game.enemyIntent.update(game.enemyQueen.position, game.sites)
+	fmt.Fprintln(os.Stderr, "We have", game.numberOfMyUnits[Knight], "Knights")
+}
+
+// playTurn Decides the queen and train actions. When anything panics, the snapshot of the turn is dumped
+// so the turn can be replayed, and the queen waits.
+func (game *Game) playTurn(snapshot GameSnapshot) (queenAction string, trainAction string) {
+	defer func() {
+		if err := recover(); err != nil {
+			fmt.Fprintln(os.Stderr, "Panic:", err)
+			fmt.Fprintln(os.Stderr, "Snapshot:", snapshot.toJSON())
+			queenAction = "WAIT"
+			trainAction = "TRAIN"
 		}
-		game.sites.setDistancesFromQueens(game.myQueen, game.enemyQueen)
-		fmt.Fprintln(os.Stderr, "We have", game.numberOfMyUnits[Knight], "Knights")
+	}()
+	return game.decideTurn()
+}
 
-		game.remainingGold = game.calculateRemainingGold()
-		fmt.Fprintln(os.Stderr, "Game Remaining Gold:", game.remainingGold)
-		game.strategy = game.determineStrategy()
-		fmt.Fprintln(os.Stderr, "Game Strategy:", game.strategy)
+// decideTurn Decides the queen and train actions of the turn
+func (game *Game) decideTurn() (string, string) {
+	game.remainingGold = game.calculateRemainingGold()
+	fmt.Fprintln(os.Stderr, "Game Remaining Gold:", game.remainingGold)
+	game.setPhase(game.determinePhase())
+	game.opponent.observe(game)
+	game.opponent.classify()
+	fmt.Fprintln(os.Stderr, "Opponent:", getOpponentName(game.opponent.label), "confidence", game.opponent.confidence)
+	game.strategy = game.determineStrategy()
+	fmt.Fprintln(os.Stderr, "Game Strategy:", game.strategy)
+	game.endgameMode = game.determineEndgameMode()
+	game.threats = game.assessThreats()
+	game.updateDefenseMode()
+	game.updateBarracksRelocation()
+	game.limits = game.getLimits()
+	if game.strategy == TooManyTowersStrategy {
+		game.updateGiantPlan()
+	}
 
-		fmt.Println(game.getQueenAction())
-		fmt.Println(game.getTrainAction())
-		fmt.Fprintln(os.Stderr, "BuildOrder:", game.getBuildOrder())
-		game.turn++
-		fmt.Fprintln(os.Stderr, "There are", len(game.enemyTowers), "enemyTowers")
+	queenAction := game.getQueenAction()
+	trainAction := game.getTrainAction()
+	if game.buildTarget != nil {
+		fmt.Fprintln(os.Stderr, "BuildTarget:", game.buildTarget.siteID, game.buildTarget.structureType, game.buildTarget.score)
 	}
+	return queenAction, trainAction
 }
 
 type SiteAndDistance struct {
@@ -256,14 +888,34 @@ func returnSortedByDistance(sites map[int]*Site) SitesByDistanceFromStart {
 	return slice
 }
 
+// returnSortedByID The sites in ID order, so dumps come out the same every time
+func returnSortedByID(sites map[int]*Site) SitesByDistanceFromStart {
+	slice := make(SitesByDistanceFromStart, 0, len(sites))
+	for ID := range sites {
+		slice = append(slice, SiteAndDistance{ID, ID})
+	}
+	sort.Sort(slice)
+	return slice
+}
+
 /************************************************
 Game Methods
 *************************************************/
 func (game *Game) determineStrategy() int {
 	strategy := DefaultStrategy
-	if len(game.enemyTowers) > 3 && game.turn > 100 {
+	if len(game.enemyTowers) > 3 && game.phase >= MidGamePhase {
 		strategy = TooManyTowersStrategy
 	}
+	if game.opponent.confidence >= OpponentConfidence {
+		switch game.opponent.label {
+		case TowerTurtleOpponent:
+			strategy = TooManyTowersStrategy
+		case KnightRushOpponent:
+			if game.opponent.confidence >= RushConfidence {
+				strategy = RushDefenseStrategy
+			}
+		}
+	}
 	return strategy
 }
 
@@ -309,50 +961,9 @@ func (game *Game) buildUnit(x int, y int, owner int, unitType int, health int) {
 	}
 }
 
+// changeSite Stores the site's new state, what changed is picked up by the EventBus
 func (game *Game) changeSite(ID int, structureType int, owner int, param1 int, param2 int, goldRemaining int, maxMineSize int) {
-	structureType = getRealStructureType(structureType, param2)
-	// Subtract changing sites from count
-	// if game changed owner and the site was owner
-	if game.sites[ID].owner != owner {
-		if game.sites[ID].owner == Friendly {
-			if game.sites[ID].getStructureType() == Tower {
-				game.numberOfTowers--
-				fmt.Fprintln(os.Stderr, "Substract game towers, total", game.numberOfTowers)
-			}
-			if game.sites[ID].getStructureType() == Barracks {
-				(*game.numberOfBarracks)[param2]--
-				fmt.Fprintln(os.Stderr, "Substract number to ", param2, " To get total of ", strconv.Itoa((*game.numberOfBarracks)[param2]))
-			}
-		} else {
-			if game.sites[ID].getStructureType() == Tower {
-				fmt.Fprintln(os.Stderr, "remove enemy tower")
-				delete(game.enemyTowers, ID)
-			}
-		}
-	}
-
-	//fmt.Fprintln(os.Stderr, "changin site ", ID, structureType, param2)
-	// Add towers
-	if structureType != game.sites[ID].getStructureType() {
-		if owner == Friendly {
-			if structureType == Tower {
-				game.numberOfTowers++
-				fmt.Fprintln(os.Stderr, "Add Game towers, total", game.numberOfTowers)
-			}
-			if structureType == Barracks {
-				(*game.numberOfBarracks)[param2]++
-				fmt.Fprintln(os.Stderr, "Add number to ", param2, " To get total of ", strconv.Itoa((*game.numberOfBarracks)[param2]))
-			}
-		} else {
-			if structureType == Tower {
-				fmt.Fprintln(os.Stderr, "add enemy tower")
-				game.enemyTowers[ID] = game.sites[ID]
-			} else if game.sites[ID].getStructureType() == Tower {
-				delete(game.enemyTowers, ID)
-			}
-		}
-	}
-	game.sites[ID].structureType = structureType
+	game.sites[ID].structureType = getRealStructureType(structureType, param2)
 	game.sites[ID].owner = owner
 	game.sites[ID].param1 = param1
 	game.sites[ID].param2 = param2
@@ -360,6 +971,35 @@ func (game *Game) changeSite(ID int, structureType int, owner int, param1 int, p
 	game.sites[ID].maxMineSize = maxMineSize
 }
 
+// countBuiltStructure Keeps numberOfTowers, numberOfBarracks and enemyTowers up to date
+func (game *Game) countBuiltStructure(event Event) {
+	if event.owner == Friendly {
+		if event.structureType == Tower {
+			game.numberOfTowers++
+			fmt.Fprintln(os.Stderr, "Add Game towers, total", game.numberOfTowers)
+		}
+		if isBarracks(event.structureType) {
+			(*game.numberOfBarracks)[getUnitForBarracks(event.structureType)]++
+		}
+	} else if event.owner == Enemy && event.structureType == Tower {
+		game.enemyTowers[event.siteID] = game.sites[event.siteID]
+	}
+}
+
+func (game *Game) countDestroyedStructure(event Event) {
+	if event.owner == Friendly {
+		if event.structureType == Tower {
+			game.numberOfTowers--
+			fmt.Fprintln(os.Stderr, "Substract game towers, total", game.numberOfTowers)
+		}
+		if isBarracks(event.structureType) {
+			(*game.numberOfBarracks)[getUnitForBarracks(event.structureType)]--
+		}
+	} else if event.owner == Enemy && event.structureType == Tower {
+		delete(game.enemyTowers, event.siteID)
+	}
+}
+
 func (game *Game) hasCountOfUnit(unitType int) int {
 	count := 0
 	for _, unit := range game.myUnits {
@@ -389,47 +1029,150 @@ func (game *Game) getCostOfUnit(unitType int) int {
 }
 
 func (game *Game) getTrainAction() string {
-	if game.strategy == DefaultStrategy {
-		if len(game.enemyTowers) > 1 && game.remainingGold >= 160 && len(game.unitBuildQueue) == 0 {
-			game.unitBuildQueue = append(game.unitBuildQueue, Knight, Knight)
-		} else if len(game.enemyTowers) <= 1 && game.remainingGold >= 80 && len(game.unitBuildQueue) == 0 {
-			game.unitBuildQueue = append(game.unitBuildQueue, Knight)
+	if game.strategy != TooManyTowersStrategy {
+		game.dropQueuedUnits(Giant)
+	}
+	if (game.strategy == DefaultStrategy || game.strategy == RushDefenseStrategy) && len(game.unitBuildQueue) == 0 {
+		// Against a rush the extra towers defend, the Knights still counter attack
+		game.queueKnightWave()
+	}
+	if game.phase == EndGamePhase && game.remainingGold >= KnightCost && len(game.unitBuildQueue) == 0 {
+		// No reason to save up anymore
+		game.queueUnits(Knight)
+	}
+	if game.endgameMode == PressureQueenMode {
+		// Spend everything on Knights, the enemy queen has to lose health
+		for i := 0; i < game.remainingGold/KnightCost; i++ {
+			game.queueUnits(Knight)
 		}
 	}
 	if game.strategy == TooManyTowersStrategy {
-		if len(game.unitBuildQueue) == 0 && game.remainingGold >= 200 {
-			game.unitBuildQueue = append(game.unitBuildQueue, Giant)
-		}
-		if game.hasCountOfUnit(Giant) > 0 && game.remainingGold >= 80 {
-			game.unitBuildQueue = append(game.unitBuildQueue, Knight)
-		}
+		game.queueGiantPush()
+	}
+	if game.defenseMode {
+		game.queueArchers()
 	}
-	// Decide train step
+	// Decide train step, a free barracks can train every turn
 	trainingLocations := ""
-	if len(game.unitBuildQueue) > 0 {
-		var unitToTrain int
-		unitToTrain = game.unitBuildQueue[0]
-		knightLocation := false
-		giantLocation := false
-		archerLocation := false
-		if unitToTrain == Knight {
-			knightLocation = true
-		} else if unitToTrain == Giant {
-			giantLocation = true
-		} else if unitToTrain == Archer {
-			archerLocation = true
-		}
-		closestAttackSiteID, _ := game.sites.findClosestSiteID(game.enemyQueen.position, true, false, false, knightLocation, false, archerLocation, false, giantLocation)
+	gold := game.gold
+	usedSites := map[int]bool{}
+	for len(game.unitBuildQueue) > 0 {
+		unitToTrain := game.unitBuildQueue[0]
+		siteID := game.findTrainingSite(unitToTrain, usedSites)
 		// Found a location and can train here.
-		if closestAttackSiteID != -1 && game.sites[closestAttackSiteID].param1 == 0 {
-			trainingLocations = trainingLocations + " " + strconv.Itoa(closestAttackSiteID)
-			game.unitBuildQueue = game.unitBuildQueue[1:]
+		if siteID == -1 || gold < game.getCostOfUnit(unitToTrain) {
+			break
+		}
+		trainingLocations = trainingLocations + " " + strconv.Itoa(siteID)
+		usedSites[siteID] = true
+		gold -= game.getCostOfUnit(unitToTrain)
+		game.unitBuildQueue = game.unitBuildQueue[1:]
+		if unitToTrain == Giant && game.giantPlan != nil {
+			game.giantPlan.giantTrainedTurn = game.turn
 		}
 	}
 
 	return "TRAIN" + trainingLocations
 }
 
+// dropQueuedUnits Takes the unit type out of the build queue, when the plan that queued it is over
+func (game *Game) dropQueuedUnits(unitType int) {
+	queue := []int{}
+	for _, queued := range game.unitBuildQueue {
+		if queued != unitType {
+			queue = append(queue, queued)
+		}
+	}
+	game.unitBuildQueue = queue
+}
+
+// findTrainingSite The barracks for the unit type that delivers the most damage, -1 if there is none
+// or when the best one is still training and we'd better wait for it.
+func (game *Game) findTrainingSite(unitType int, usedSites map[int]bool) int {
+	bestSiteID := -1
+	bestScore := math.Inf(-1)
+	for _, siteAndID := range returnSortedByID(game.sites) {
+		site := game.sites[siteAndID.ID]
+		if site.owner != Friendly || site.getStructureType() != getBarracksForUnit(unitType) || usedSites[site.ID] {
+			continue
+		}
+		score := game.scoreTrainingSite(site, unitType)
+		// On a tie, the barracks that can train right away
+		if score > bestScore || (score == bestScore && site.param1 < game.sites[bestSiteID].param1) {
+			bestSiteID = site.ID
+			bestScore = score
+		}
+	}
+	if bestSiteID != -1 && game.sites[bestSiteID].param1 > 0 {
+		fmt.Fprintln(os.Stderr, "Waiting for barracks", bestSiteID, "to train", unitType)
+		return -1
+	}
+	return bestSiteID
+}
+
+// scoreTrainingSite The health the trained units have left when they reach their target: what the enemy towers
+// on the way take, and what decays while waiting for the barracks, training and walking. Knights walk to where
+// the enemy queen will be by then, Giants to their tower and Archers to our queen.
+func (game *Game) scoreTrainingSite(site *Site, unitType int) float64 {
+	speed := getUnitSpeed(unitType)
+	target := game.myQueen.position
+	switch unitType {
+	case Knight:
+		target = game.enemyQueen.position
+	case Giant:
+		target = game.getGiantTarget()
+	}
+	arrival := site.param1 + getTrainTurns(unitType) + getTurnsToTravel(site.position.distanceTo(target), speed)
+	if unitType == Knight {
+		// Aim for where the enemy queen will be, and how long it takes to get there
+		target = game.enemyIntent.predictPosition(arrival, game.sites)
+		arrival = site.param1 + getTrainTurns(unitType) + getTurnsToTravel(site.position.distanceTo(target), speed)
+	}
+
+	units := getUnitsPerTraining(unitType)
+	health := units*getUnitHealth(unitType) - units*arrival*UnitDecay
+	if unitType != Archer {
+		for _, tower := range game.enemyTowers {
+			length := segmentLengthInCircle(site.position, target, tower.position, float64(tower.param2))
+			health -= getTurnsToTravel(length, speed) * (TowerCreepDamage + tower.param2/400)
+		}
+	}
+	return float64(health)
+}
+
+// getGiantTarget The tower the Giant push goes for, otherwise the closest enemy tower, otherwise the enemy queen
+func (game *Game) getGiantTarget() Position {
+	if game.giantPlan != nil && len(game.giantPlan.targetIDs) > 0 {
+		return game.sites[game.giantPlan.targetIDs[0]].position
+	}
+	towerID, _ := game.sites.findClosestSiteID(game.myQueen.position, false, true, false, false, true, false, false, false)
+	if towerID != -1 {
+		return game.sites[towerID].position
+	}
+	return game.enemyQueen.position
+}
+
+// findFreeBarracks Our barracks for the unit type that aren't training
+func (game *Game) findFreeBarracks(unitType int) []*Site {
+	barracks := []*Site{}
+	for _, site := range game.sites {
+		if site.owner == Friendly && site.getStructureType() == getBarracksForUnit(unitType) && site.param1 == 0 {
+			barracks = append(barracks, site)
+		}
+	}
+	return barracks
+}
+
+// queueUnits Adds the units to the build queue, as long as they stay within the limits.
+func (game *Game) queueUnits(unitTypes ...int) {
+	for _, unitType := range unitTypes {
+		if game.isUnitCapped(unitType) {
+			return
+		}
+		game.unitBuildQueue = append(game.unitBuildQueue, unitType)
+	}
+}
+
 func (game *Game) getBuildCommand(siteID int, structureType int) string {
 	fmt.Fprintln(os.Stderr, "Building ", structureType, " AT ", siteID)
 	building := "MINE"
@@ -459,123 +1202,2215 @@ func (game *Game) areEnemyUnitsNear(position Position) bool {
 func (game *Game) getQueenAction() string {
 	fmt.Fprintln(os.Stderr, "TouchsiteID", game.touchedSite)
 	areEnemiesNear := game.areEnemyUnitsNear(game.myQueen.position)
-	if areEnemiesNear && game.numberOfTowers == 0 {
-		fmt.Fprintln(os.Stderr, "Panic mode, build tower (enemies near and no towers)")
-		// There are enemies close, and we have no defences!
+	turnsToImpact, threatDamage := game.getQueenThreat()
+	if turnsToImpact <= ThreatHorizon && game.numberOfTowers == 0 {
+		fmt.Fprintln(os.Stderr, "Panic mode, build tower (Knights arrive in", turnsToImpact, "turns and no towers)")
+		// There are enemies coming, and we have no defences!
 		closestSiteID, _ := game.sites.findClosestSiteID(game.myQueen.position, false, true, true, false, false, false, false, false)
 		if game.touchedSite == closestSiteID {
 			// Build the Tower! you're close enough
 			return game.getBuildCommand(game.touchedSite, Tower)
 		}
+		if closestSiteID != -1 && game.sites[closestSiteID].distanceFromMyQueen < QueenSpeed*turnsToImpact {
+			// Still time to get there before they arrive
+			return game.getMoveOrderForSite(game.sites[closestSiteID])
+		}
 	}
 
-	if game.myQueen.health < 10 {
-		return game.getMoveToEdge()
+	if turnsToImpact <= ThreatHorizon && threatDamage >= RetreatThreatDamage {
+		fmt.Fprintln(os.Stderr, "Evade, Knights arrive in", turnsToImpact, "turns for", threatDamage, "damage")
+		return game.getEvasionMove()
 	}
 
-	// Follow build order when touching a site.
-	buildOrder := game.getBuildOrder()
+	if game.myQueen.health < game.getRetreatHealth() {
+		return game.getMoveToEdge()
+	}
+
+	if game.endgameMode == PreserveHealthMode &&
+		(areEnemiesNear || game.isInEnemyTowerRange(game.myQueen.position)) {
+		fmt.Fprintln(os.Stderr, "Preserve queen health, avoid enemies")
+		return game.getMoveToEdge()
+	}
+
+	// Build the planned structure when touching its site.
+	target := game.planNextBuild()
+	if target != nil && game.touchedSite == target.siteID {
+		if target.structureType == Goldmine && game.areEnemyUnitsNear(game.sites[game.touchedSite].position) {
+			// Enemies are near, build a Tower instead
+			fmt.Fprintln(os.Stderr, "Replace goldmine with Tower")
+			return game.getBuildCommand(game.touchedSite, Tower)
+		}
+		fmt.Fprintln(os.Stderr, "Build the planned structure on touched site, seeing:", game.sites[game.touchedSite].getStructureType(), "Building:", target.structureType)
+		return game.getBuildCommand(game.touchedSite, target.structureType)
+	}
+
+	// Upgrade mine logic
+	if game.touchedSite != Neutral &&
+		game.sites[game.touchedSite].owner == Friendly &&
+		game.sites[game.touchedSite].maxMineSize != game.sites[game.touchedSite].param1 &&
+		game.sites[game.touchedSite].getStructureType() == Goldmine &&
+		game.sites[game.touchedSite].goldRemaining > IgnoreGoldmine &&
+		game.shouldUpgradeMine(game.sites[game.touchedSite]) {
+		fmt.Fprintln(os.Stderr, "Upgrade Goldmine")
+		return game.getBuildCommand(game.touchedSite, Goldmine)
+	}
+
+	// Upgrade Tower logic
+	if game.touchedSite != Neutral &&
+		game.sites[game.touchedSite].owner == Friendly &&
+		game.sites[game.touchedSite].getStructureType() == Tower &&
+		game.sites[game.touchedSite].param2 < MinTowerRangeConstruction {
+		fmt.Fprintln(os.Stderr, "Upgrade Tower")
+		return game.getBuildCommand(game.touchedSite, Tower)
+	}
+
+	// Move to the planned build location
+	if target != nil {
+		fmt.Fprintln(os.Stderr, "Move to planned site", target.siteID)
+		return game.getMoveOrderForSite(game.sites[target.siteID])
+	}
+
+	// Everything's done! Move to safety (aka your corner of the map)
+	fmt.Fprintln(os.Stderr, "Move to edge!")
+	return game.getMoveToEdge()
+}
+
+func (game *Game) getMoveOrderForSite(site *Site) string {
+	return game.getMoveCommand(site.position)
+}
+
+func (game *Game) getMoveToEdge() string {
+	return game.getMoveCommand(game.findSafeZone())
+}
+
+// getMoveCommand Turns our (left side) position back into the real one.
+func (game *Game) getMoveCommand(position Position) string {
+	position = game.toWorld(position)
+	return "MOVE " + strconv.Itoa(position.x) + " " + strconv.Itoa(position.y)
+}
+
+//func (game *Game) getMoveToClosestFriendlyTower() string {
+//closestSiteID, _ = game.sites.findClosestSiteID(game.myQueen.position.x, game.myQueen.position.y, true, false, false, false, true, false)
+//fmt.Fprintln(os.Stderr, "Moving to closest friendly tower!", closestSiteID)
+//}
+
+// findClosestEdge Our corner of the map, we're always on the left side.
+func (game *Game) findClosestEdge() Position {
+	return Position{
+		x: 0,
+		y: 0,
+	}
+}
+
+/************************************************
+Build Planner
+*************************************************/
+
+// BuildCandidate A structure we could place on a site, and how much we want it
+type BuildCandidate struct {
+	siteID        int
+	structureType int
+	score         float64
+}
+
+// KeepTargetBonus Extra score for the current target, so the queen doesn't change her mind every turn
+const KeepTargetBonus = 15.0
+
+// planNextBuild Scores every buildable site for every structure type and picks the best one.
+func (game *Game) planNextBuild() *BuildCandidate {
+	game.approachPoints = game.getApproachPoints()
+	game.contestedSites = game.analyzeContestedSites()
+	var best *BuildCandidate
+	for _, structureType := range []int{Goldmine, Tower, Barracks, GiantBarracks, ArcherBarracks} {
+		if game.isStructureCapped(structureType) {
+			continue
+		}
+		// Sites in ID order, so a tie always goes the same way
+		for _, siteAndID := range returnSortedByID(game.sites) {
+			site := game.sites[siteAndID.ID]
+			if !game.canBuildOn(site, structureType) {
+				continue
+			}
+			candidate := &BuildCandidate{
+				siteID:        site.ID,
+				structureType: structureType,
+				score:         game.scoreBuildCandidate(site, structureType),
+			}
+			if game.buildTarget != nil && game.buildTarget.siteID == site.ID && game.buildTarget.structureType == structureType {
+				candidate.score += KeepTargetBonus
+			}
+			if best == nil || candidate.score > best.score {
+				best = candidate
+			}
+		}
+	}
+	game.buildTarget = best
+	return best
+}
+
+// canBuildOn Can (and should) the queen place this structure type on the site?
+func (game *Game) canBuildOn(site *Site, structureType int) bool {
+	if site.owner == Enemy && (site.getStructureType() == Tower || game.getSabotageValue(site) <= 0) {
+		// Enemy towers can't be built over, the rest only when it's worth it
+		return false
+	}
+	if site.owner == Friendly {
+		// Only emptied goldmines and barracks we've moved are worth replacing (with a Tower)
+		if game.relocation != nil && game.relocation.fromSiteID == site.ID && game.relocation.isDone(game) {
+			return structureType == Tower
+		}
+		return structureType == Tower && site.getStructureType() == Goldmine && site.isDepleted()
+	}
+	if structureType == Goldmine && site.isDepleted() {
+		return false
+	}
+	return true
+}
+
+func (game *Game) countStructures(structureType int) int {
+	return game.sites.countStructures(Friendly, structureType)
+}
+
+// scoreBuildCandidate Higher is better. Combines income, defence, distance to the enemy and how far we are from the Max* limits.
+func (game *Game) scoreBuildCandidate(site *Site, structureType int) float64 {
+	score := 0.0
+	switch structureType {
+	case Goldmine:
+		// Income value, unknown mines (-1) count as a small mine
+		mineSize := site.maxMineSize
+		if mineSize < 1 {
+			mineSize = 1
+		}
+		score = 100 + float64(mineSize*10)
+		if game.areEnemyUnitsNear(site.position) {
+			score -= 50
+		}
+		// Mines near our starting location are easier to defend
+		score -= float64(site.distanceFromStartingLocation) / 40
+	case Tower:
+		// Defensive coverage of the enemy's approach lanes
+		score = 70 + game.scoreTowerPlacement(site)
+	case ArcherBarracks:
+		// Archers defend, so close to home
+		score = 60 + float64(FieldWidth-site.distanceFromStartingLocation)/50
+		if game.defenseMode {
+			score += 60
+		}
+	case Barracks, GiantBarracks:
+		score = 60 + game.scoreBarracksPlacement(site)
+		if structureType == GiantBarracks {
+			score += 90
+			if game.giantPlan != nil && game.giantPlan.barracksSiteID == site.ID {
+				score += 50
+			}
+		}
+		if structureType == Barracks && game.relocation != nil && game.relocation.toSiteID == site.ID {
+			score += 50
+		}
+	}
+
+	// Economy and defence should not end up next to the enemy queen
+	if structureType == Goldmine || structureType == Tower {
+		if site.distanceFromEnemyQueen < site.distanceFromMyQueen {
+			score -= float64(site.distanceFromMyQueen-site.distanceFromEnemyQueen) / 10
+		}
+	}
+
+	score += game.getPhaseBuildBonus(structureType)
+
+	if site.owner == Enemy {
+		score += float64(game.getSabotageValue(site)) / 10
+	}
+
+	if contested, ok := game.contestedSites[site.ID]; ok {
+		if contested.claimAs == structureType {
+			score += 40
+		} else {
+			score -= 40
+		}
+	}
+
+	// Winning on health, don't walk towards the enemy
+	if game.endgameMode == PreserveHealthMode && site.distanceFromEnemyQueen < site.distanceFromMyQueen {
+		score -= 100
+	}
+
+	// Prefer types we have the fewest of, compared to their limits
+	limit := game.limits.forStructure(structureType)
+	if limit > 0 {
+		score += 20 * float64(limit-game.countStructures(structureType)) / float64(limit)
+	}
+
+	// Queen travel cost
+	score -= float64(site.distanceFromMyQueen) / 20
+
+	return score
+}
+
+/************************************************
+Game Phase Methods
+*************************************************/
+
+// determinePhase Classifies the game by turn, gold left in the mines, our structures and the army sizes. Phases only move forward.
+func (game *Game) determinePhase() int {
+	phase := OpeningPhase
+	if game.turn > OpeningTurns || game.countStructures(Goldmine) >= 2 {
+		phase = ExpansionPhase
+	}
+	if (game.countStructures(Goldmine) >= MaxGoldMines && game.countStructures(Barracks) > 0) ||
+		len(game.myUnits)+len(game.enemyUnits) >= MidGameArmySize {
+		phase = MidGamePhase
+	}
+	// Only trust the gold left when we've seen at least half the sites
+	goldRemaining, known := game.sites.totalGoldRemaining()
+	if game.turn >= MaxTurns-EndGameTurns || (game.turn > OpeningTurns && known*2 >= len(game.sites) && goldRemaining < EndGameMineGold) {
+		phase = EndGamePhase
+	}
+	if phase < game.phase {
+		return game.phase
+	}
+	return phase
+}
+
+func (game *Game) setPhase(phase int) {
+	if phase != game.phase {
+		fmt.Fprintln(os.Stderr, "Phase change on turn", game.turn, ":", getPhaseName(game.phase), "->", getPhaseName(phase))
+	}
+	game.phase = phase
+	fmt.Fprintln(os.Stderr, "Game Phase:", getPhaseName(game.phase))
+}
+
+// getPhaseBuildBonus Mines early, towers late.
+func (game *Game) getPhaseBuildBonus(structureType int) float64 {
+	switch game.phase {
+	case OpeningPhase:
+		if structureType == Goldmine {
+			return 30
+		}
+	case MidGamePhase:
+		if structureType == Barracks {
+			return 20
+		}
+	case EndGamePhase:
+		if structureType == Tower {
+			return 30
+		}
+	}
+	if game.strategy == RushDefenseStrategy && structureType == Tower {
+		return 30
+	}
+	return 0
+}
+
+// getRetreatHealth Below this health the queen runs to safety. In the endgame every hit point counts.
+func (game *Game) getRetreatHealth() int {
+	switch game.phase {
+	case OpeningPhase:
+		return 5
+	case EndGamePhase:
+		return 20
+	}
+	return 10
+}
+
+func getPhaseName(phase int) string {
+	switch phase {
+	case OpeningPhase:
+		return "opening"
+	case ExpansionPhase:
+		return "expansion"
+	case MidGamePhase:
+		return "mid-game"
+	case EndGamePhase:
+		return "endgame"
+	}
+	return "unknown"
+}
+
+/************************************************
+Endgame Methods
+*************************************************/
+
+// determineEndgameMode In the last turns, predict both queens' health at MaxTurns with the forward model.
+// Ahead: preserve our queen's health. Behind (or close): pressure the enemy queen.
+func (game *Game) determineEndgameMode() int {
+	if game.turn < MaxTurns-TiebreakTurns {
+		return NoEndgameMode
+	}
+	prediction := game.predictUnits(MaxTurns - game.turn)
+	myHealth := game.myQueen.health - prediction.queenDamage[Friendly]
+	enemyHealth := game.enemyQueen.health - prediction.queenDamage[Enemy]
+	fmt.Fprintln(os.Stderr, "Predicted queen health at turn", MaxTurns, "mine:", myHealth, "enemy:", enemyHealth)
+	if myHealth > enemyHealth+TiebreakMargin {
+		fmt.Fprintln(os.Stderr, "Endgame: preserve queen health")
+		return PreserveHealthMode
+	}
+	fmt.Fprintln(os.Stderr, "Endgame: pressure enemy queen")
+	return PressureQueenMode
+}
+
+func (game *Game) isInEnemyTowerRange(position Position) bool {
+	for _, tower := range game.enemyTowers {
+		if position.isInCircle(tower.position, float64(tower.param2)) {
+			return true
+		}
+	}
+	return false
+}
+
+/************************************************
+Threat Methods
+*************************************************/
+
+// assessThreats Works out for every enemy unit what it's going for, when it gets there and how much damage it can do.
+// Knights go for our queen, Giants for our closest Tower and Archers for our closest unit.
+func (game *Game) assessThreats() []Threat {
+	threats := []Threat{}
+	for _, unit := range game.enemyUnits {
+		threat := Threat{
+			unit:         unit,
+			targetSiteID: -1,
+		}
+		switch unit.unitType {
+		case Knight:
+			threat.target = QueenTarget
+			distance := distanceBetween(unit.position, game.myQueen.position) - QueenRadius - KnightRadius
+			threat.turnsToImpact = getTurnsToTravel(distance, KnightSpeed)
+			// A Knight keeps hitting until it decays
+			threat.damage = KnightDamage * maxInt(0, unit.health-threat.turnsToImpact)
+		case Giant:
+			towerID, distance := game.sites.findClosestSiteID(unit.position, true, false, false, false, true, false, false, false)
+			if towerID == -1 {
+				continue
+			}
+			threat.target = StructureTarget
+			threat.targetSiteID = towerID
+			threat.turnsToImpact = getTurnsToTravel(distance-float64(game.sites[towerID].radius)-GiantRadius, GiantSpeed)
+			threat.damage = GiantDamage
+		case Archer:
+			if len(game.myUnits) == 0 {
+				continue
+			}
+			closest := game.myUnits[0]
+			for _, myUnit := range game.myUnits {
+				if distanceBetween(unit.position, myUnit.position) < distanceBetween(unit.position, closest.position) {
+					closest = myUnit
+				}
+			}
+			threat.target = UnitTarget
+			threat.turnsToImpact = getTurnsToTravel(distanceBetween(unit.position, closest.position)-ArcherRange, ArcherSpeed)
+			threat.damage = ArcherDamage
+		}
+		threats = append(threats, threat)
+	}
+	return threats
+}
+
+// getQueenThreat How many turns until the first Knight reaches our queen, and how much damage the Knights arriving within the ThreatHorizon can do.
+func (game *Game) getQueenThreat() (int, int) {
+	turnsToImpact := MaxTurns
+	damage := 0
+	for _, threat := range game.threats {
+		if threat.target != QueenTarget {
+			continue
+		}
+		if threat.turnsToImpact < turnsToImpact {
+			turnsToImpact = threat.turnsToImpact
+		}
+		if threat.turnsToImpact <= ThreatHorizon {
+			damage += threat.damage
+		}
+	}
+	return turnsToImpact, damage
+}
+
+/************************************************
+Safe Zone Methods
+*************************************************/
+
+// findSafeZone The best reachable position to retreat to: away from enemy units and enemy towers, and covered by our own towers.
+func (game *Game) findSafeZone() Position {
+	candidates := []Position{game.findClosestEdge()}
+	for x := 0; x <= FieldWidth; x += SafeZoneGridStep {
+		for y := 0; y <= FieldHeight; y += SafeZoneGridStep {
+			candidates = append(candidates, Position{x: x, y: y})
+		}
+	}
+
+	best := candidates[0]
+	bestScore := math.Inf(-1)
+	for _, candidate := range candidates {
+		score := game.scoreSafeZone(candidate)
+		if score > bestScore {
+			best = candidate
+			bestScore = score
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Safe zone", best.x, best.y, "score", bestScore)
+	return best
+}
+
+// scoreSafeZone Higher is safer
+func (game *Game) scoreSafeZone(position Position) float64 {
+	score := 0.0
+
+	// Distance from the closest enemy unit (and the enemy queen)
+	closestEnemy := float64(SafeZoneEnemyDistance)
+	for _, unit := range append([]Unit{game.enemyQueen}, game.enemyUnits...) {
+		closestEnemy = math.Min(closestEnemy, distanceBetween(position, unit.position))
+	}
+	score += closestEnemy / 10
+
+	// Our own side of the field is safer than the enemy's
+	score += distanceBetween(position, game.enemyQueenStartingPosition) / 40
+
+	// Our towers protect us, enemy towers hurt
+	for _, site := range game.sites {
+		distance := distanceBetween(position, site.position)
+		if distance < float64(site.radius+QueenRadius) {
+			// Can't stand on a site
+			return math.Inf(-1)
+		}
+		if site.getStructureType() != Tower {
+			continue
+		}
+		if site.owner == Friendly && distance <= float64(site.param2) {
+			score += 20
+		}
+		if site.owner == Enemy {
+			if distance <= float64(site.param2) {
+				score -= 100
+			}
+			score += math.Min(distance, SafeZoneEnemyDistance) / 20
+		}
+	}
+
+	// It has to be reachable: not too far, and not past the enemy units
+	score -= distanceBetween(game.myQueen.position, position) / 20
+	for _, unit := range game.enemyUnits {
+		if unit.unitType == Knight && segmentIntersectsCircle(game.myQueen.position, position, unit.position, QueenRadius+KnightRadius+KnightSpeed) {
+			score -= 30
+		}
+	}
+	return score
+}
+
+/************************************************
+Evasion Methods
+*************************************************/
+
+// getEvasionMove Tries moving in every direction and towards every friendly Tower,
+// and picks the move where the chasing Knights do the least damage.
+func (game *Game) getEvasionMove() string {
+	candidates := []Position{}
+	for i := 0; i < EvasionDirections; i++ {
+		angle := 2 * math.Pi * float64(i) / EvasionDirections
+		direction := Position{
+			x: int(math.Cos(angle) * 1000),
+			y: int(math.Sin(angle) * 1000),
+		}
+		candidates = append(candidates, game.myQueen.position.add(direction.normalize(QueenSpeed*EvasionTurns)).clampToField())
+	}
+	for _, tower := range game.sites.findTowers(Friendly) {
+		candidates = append(candidates, tower.position)
+	}
+
+	best := candidates[0]
+	bestDamage := math.MaxFloat64
+	for _, candidate := range candidates {
+		damage := game.simulateEvasion(candidate)
+		if damage < bestDamage {
+			best = candidate
+			bestDamage = damage
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Evasion move", best.x, best.y, "expected damage", bestDamage)
+	return game.getMoveCommand(best)
+}
+
+// simulateEvasion The damage our queen takes over the EvasionTurns when she walks towards the target
+// and the Knights chase her, plus a penalty for ending up cornered against the field edge or a site.
+func (game *Game) simulateEvasion(target Position) float64 {
+	chasers := []Unit{}
+	for _, unit := range game.enemyUnits {
+		if unit.unitType == Knight {
+			chasers = append(chasers, unit)
+		}
+	}
+	towers := game.sites.findTowers(Friendly)
+
+	queen := game.myQueen.position
+	damage := 0.0
+	for turn := 0; turn < EvasionTurns; turn++ {
+		queen = queen.step(target, QueenSpeed)
+		for i := range chasers {
+			knight := &chasers[i]
+			if knight.health <= 0 {
+				continue
+			}
+			knight.position = knight.position.step(queen, KnightSpeed)
+			if knight.position.distanceTo(queen) <= QueenRadius+KnightRadius {
+				damage += KnightDamage
+			}
+			// Our towers shoot the Knights, and they decay
+			for _, tower := range towers {
+				distance := knight.position.distanceTo(tower.position)
+				if distance <= float64(tower.param2) {
+					knight.health -= TowerCreepDamage + (tower.param2-int(distance))/200
+				}
+			}
+			knight.health--
+		}
+	}
+
+	// Getting cornered means the Knights will catch up after the simulation
+	margin := QueenRadius + QueenSpeed
+	if queen.x < margin || queen.x > FieldWidth-margin {
+		damage += 2
+	}
+	if queen.y < margin || queen.y > FieldHeight-margin {
+		damage += 2
+	}
+	for _, site := range game.sites {
+		if queen.distanceTo(site.position) < float64(site.radius+QueenRadius) {
+			damage++
+		}
+	}
+	return damage
+}
+
+/************************************************
+Simulation Methods
+*************************************************/
+
+// predictUnits Runs the forward model on the current units and towers for the turns.
+func (game *Game) predictUnits(turns int) Prediction {
+	towers := []*Site{}
+	for _, site := range game.sites {
+		if site.getStructureType() == Tower && site.owner != Neutral {
+			towers = append(towers, site)
+		}
+	}
+	units := append(append([]Unit{}, game.myUnits...), game.enemyUnits...)
+	simulation := newSimulation(game.myQueen, game.enemyQueen, units, towers)
+	return simulation.run(turns)
+}
+
+// newSimulation Copies the units and towers, so simulating never changes the game.
+// The queens stand still, everything else follows the Code Royale unit AI.
+func newSimulation(myQueen Unit, enemyQueen Unit, units []Unit, towers []*Site) *Simulation {
+	simulation := &Simulation{
+		queens: map[int]Unit{
+			Friendly: myQueen,
+			Enemy:    enemyQueen,
+		},
+		units:  append([]Unit{}, units...),
+		towers: []Site{},
+		result: Prediction{
+			queenDamage:     map[int]int{},
+			structureDamage: map[int]int{},
+		},
+	}
+	for _, tower := range towers {
+		simulation.towers = append(simulation.towers, *tower)
+	}
+	return simulation
+}
+
+func (simulation *Simulation) run(turns int) Prediction {
+	for turn := 0; turn < turns; turn++ {
+		simulation.step()
+	}
+	simulation.result.turns = simulation.turn
+	simulation.result.units = simulation.units
+	return simulation.result
+}
+
+// step One turn: units move, units attack, towers shoot, and everything decays.
+func (simulation *Simulation) step() {
+	simulation.turn++
+	damage := make([]int, len(simulation.units))
+	for i := range simulation.units {
+		unit := &simulation.units[i]
+		switch unit.unitType {
+		case Knight:
+			queen := simulation.queens[getOpponent(unit.owner)]
+			unit.position = unit.position.step(queen.position, KnightSpeed)
+			if unit.position.distanceTo(queen.position) <= QueenRadius+KnightRadius {
+				simulation.damageQueen(queen.owner, KnightDamage)
+			}
+		case Giant:
+			tower := simulation.findClosestTower(unit.position, getOpponent(unit.owner))
+			if tower == nil {
+				unit.position = unit.position.step(simulation.queens[getOpponent(unit.owner)].position, GiantSpeed)
+				continue
+			}
+			unit.position = unit.position.step(tower.position, GiantSpeed)
+			if unit.position.distanceTo(tower.position) <= float64(tower.radius+GiantRadius) {
+				simulation.damageTower(tower, GiantDamage)
+			}
+		case Archer:
+			target := simulation.findClosestUnit(unit.position, getOpponent(unit.owner))
+			if target == -1 {
+				unit.position = unit.position.step(simulation.queens[unit.owner].position, ArcherSpeed)
+				continue
+			}
+			targetUnit := simulation.units[target]
+			if unit.position.distanceTo(targetUnit.position) > ArcherRange {
+				unit.position = unit.position.step(targetUnit.position, ArcherSpeed)
+			}
+			if unit.position.distanceTo(targetUnit.position) <= ArcherRange {
+				if targetUnit.unitType == Giant {
+					damage[target] += ArcherGiantDamage
+				} else {
+					damage[target] += ArcherDamage
+				}
+			}
+		}
+	}
+
+	// Towers shoot the closest enemy unit, or the enemy queen when no units are in range
+	for i := range simulation.towers {
+		tower := &simulation.towers[i]
+		if tower.param1 <= 0 {
+			continue
+		}
+		enemy := getOpponent(tower.owner)
+		target := simulation.findClosestUnit(tower.position, enemy)
+		if target != -1 && tower.position.distanceTo(simulation.units[target].position) <= float64(tower.param2) {
+			damage[target] += TowerCreepDamage + (tower.param2-int(tower.position.distanceTo(simulation.units[target].position)))/200
+		} else if queen := simulation.queens[enemy]; tower.position.distanceTo(queen.position) <= float64(tower.param2) {
+			simulation.damageQueen(enemy, TowerQueenDamage+(tower.param2-int(tower.position.distanceTo(queen.position)))/200)
+		}
+		simulation.damageTower(tower, TowerMeltRate)
+	}
+
+	alive := []Unit{}
+	for i, unit := range simulation.units {
+		unit.health -= damage[i] + UnitDecay
+		if unit.health <= 0 {
+			simulation.result.deaths = append(simulation.result.deaths, UnitDeath{unit: unit, turn: simulation.turn})
+			continue
+		}
+		alive = append(alive, unit)
+	}
+	simulation.units = alive
+}
+
+func (simulation *Simulation) damageQueen(owner int, damage int) {
+	queen := simulation.queens[owner]
+	queen.health -= damage
+	simulation.queens[owner] = queen
+	simulation.result.queenDamage[owner] += damage
+}
+
+// damageTower Towers shrink as they lose health, and are gone at 0
+func (simulation *Simulation) damageTower(tower *Site, damage int) {
+	if tower.param1 <= 0 {
+		return
+	}
+	tower.param1 -= damage
+	simulation.result.structureDamage[tower.ID] += damage
+	if tower.param1 <= 0 {
+		tower.param1 = 0
+		tower.param2 = 0
+		simulation.result.destroyedStructures = append(simulation.result.destroyedStructures, tower.ID)
+		return
+	}
+	tower.param2 = getTowerRange(tower.param1, tower.radius)
+}
+
+func (simulation *Simulation) findClosestTower(position Position, owner int) *Site {
+	var closest *Site
+	for i := range simulation.towers {
+		tower := &simulation.towers[i]
+		if tower.owner != owner || tower.param1 <= 0 {
+			continue
+		}
+		if closest == nil || position.distanceSquared(tower.position) < position.distanceSquared(closest.position) {
+			closest = tower
+		}
+	}
+	return closest
+}
+
+// findClosestUnit Index of the closest unit of the owner, -1 if there are none
+func (simulation *Simulation) findClosestUnit(position Position, owner int) int {
+	closest := -1
+	for i, unit := range simulation.units {
+		if unit.owner != owner {
+			continue
+		}
+		if closest == -1 || position.distanceSquared(unit.position) < position.distanceSquared(simulation.units[closest].position) {
+			closest = i
+		}
+	}
+	return closest
+}
+
+/************************************************
+Giant Push Methods
+*************************************************/
+
+// updateGiantPlan Picks the towers to go for, the site for the Giant barracks and how long the Knights wait,
+// so the Giant and its escort reach the first tower together.
+func (game *Game) updateGiantPlan() {
+	if game.giantPlan == nil {
+		game.giantPlan = &GiantPlan{barracksSiteID: -1}
+	}
+	plan := game.giantPlan
+
+	// The push is over once the Giant is gone
+	if plan.escortQueued && game.hasCountOfUnit(Giant) == 0 && game.turn > plan.giantTrainedTurn+GiantTrainTurns {
+		fmt.Fprintln(os.Stderr, "Giant push over")
+		plan.giantTrainedTurn = 0
+		plan.escortQueued = false
+	}
+
+	plan.targetIDs = game.pickGiantTargets()
+	if len(plan.targetIDs) == 0 {
+		plan.worthIt = false
+		return
+	}
+	target := game.sites[plan.targetIDs[0]]
+
+	plan.barracksSiteID, _ = game.sites.findClosestSiteID(target.position, true, false, false, false, false, false, false, true)
+	if plan.barracksSiteID == -1 {
+		plan.barracksSiteID = game.findGiantBarracksSite(target)
+	}
+	if plan.barracksSiteID == -1 {
+		plan.worthIt = false
+		return
+	}
+	giantSite := game.sites[plan.barracksSiteID]
+	giantArrival := GiantTrainTurns + getTurnsToTravel(giantSite.position.distanceTo(target.position), GiantSpeed)
+	knightArrival := giantArrival
+	knightSiteID, _ := game.sites.findClosestSiteID(target.position, true, false, false, true, false, false, false, false)
+	if knightSiteID != -1 {
+		knightArrival = KnightTrainTurns + getTurnsToTravel(game.sites[knightSiteID].position.distanceTo(target.position), KnightSpeed)
+	}
+	plan.knightDelay = maxInt(0, giantArrival-knightArrival)
+
+	// Compare with spending the gold on what a mine brings in for the rest of the game
+	pushValue := len(plan.targetIDs) * GiantPushTowerValue
+	mineValue := MineIncome * (MaxTurns - game.turn)
+	if game.countStructures(Goldmine) >= game.limits.goldMines {
+		mineValue = 0
+	}
+	plan.worthIt = pushValue-GiantCost-KnightCost > mineValue
+	fmt.Fprintln(os.Stderr, "Giant push on", plan.targetIDs, "from", plan.barracksSiteID, "knight delay", plan.knightDelay, "worth it", plan.worthIt)
+}
+
+// pickGiantTargets The enemy towers one Giant can take down, weakest first. A Giant hits a tower
+// every turn, and gets shot by it every turn.
+func (game *Game) pickGiantTargets() []int {
+	towers := []*Site{}
+	for _, tower := range game.enemyTowers {
+		towers = append(towers, tower)
+	}
+	sort.Slice(towers, func(i, j int) bool {
+		if towers[i].param1 != towers[j].param1 {
+			return towers[i].param1 < towers[j].param1
+		}
+		return towers[i].distanceFromStartingLocation < towers[j].distanceFromStartingLocation
+	})
+
+	targets := []int{}
+	giantHealth := GiantHealth
+	for _, tower := range towers {
+		hits := getTurnsToTravel(float64(tower.param1), GiantDamage)
+		// Every tower in range shoots while the Giant is busy
+		damage := hits * (TowerCreepDamage + tower.param2/200) * maxInt(1, game.sites.countTowersCovering(tower.position, Enemy))
+		if damage >= giantHealth {
+			break
+		}
+		giantHealth -= damage
+		targets = append(targets, tower.ID)
+	}
+	return targets
+}
+
+// findGiantBarracksSite The buildable site closest to the target, without being in range of an enemy tower
+func (game *Game) findGiantBarracksSite(target *Site) int {
+	best := -1
+	bestCost := math.MaxFloat64
+	for _, site := range game.sites {
+		if !game.canBuildOn(site, GiantBarracks) || game.isInEnemyTowerRange(site.position) {
+			continue
+		}
+		cost := site.position.distanceTo(target.position) + float64(site.distanceFromMyQueen)/2
+		if cost < bestCost {
+			best = site.ID
+			bestCost = cost
+		}
+	}
+	return best
+}
+
+// queueGiantPush Queues the Giant when we can afford it and its escort, then the Knights once they'd arrive together.
+func (game *Game) queueGiantPush() {
+	plan := game.giantPlan
+	if plan == nil || !plan.worthIt {
+		return
+	}
+	if plan.giantTrainedTurn == 0 {
+		// Until the Giant barracks is up, a queued Giant would only block the queue
+		if game.countStructures(GiantBarracks) == 0 {
+			return
+		}
+		if len(game.unitBuildQueue) == 0 && game.remainingGold >= GiantCost+KnightCost {
+			game.queueUnits(Giant)
+		}
+		return
+	}
+	if !plan.escortQueued && game.turn >= plan.giantTrainedTurn+plan.knightDelay && game.remainingGold >= KnightCost {
+		game.queueUnits(Knight)
+		plan.escortQueued = true
+	}
+}
+
+/************************************************
+Defense Methods
+*************************************************/
+
+// updateDefenseMode Switches the archer defense on when enemy Knights keep coming to our half, and off when they've stopped.
+func (game *Game) updateDefenseMode() {
+	game.knightPressure = append(game.knightPressure, game.countEnemyKnightsOnOurHalf())
+	if len(game.knightPressure) > DefensePressureTurns {
+		game.knightPressure = game.knightPressure[1:]
+	}
+	total := 0
+	for _, knights := range game.knightPressure {
+		total += knights
+	}
+	// Over the whole window, turns we haven't seen yet count as no pressure, so one wave isn't sustained pressure
+	pressure := float64(total) / DefensePressureTurns
+
+	if !game.defenseMode && pressure >= DefenseEnterKnights {
+		fmt.Fprintln(os.Stderr, "Defense mode on, Knight pressure", pressure)
+		game.defenseMode = true
+	} else if game.defenseMode && pressure < DefenseExitKnights {
+		fmt.Fprintln(os.Stderr, "Defense mode off, Knight pressure", pressure)
+		game.defenseMode = false
+	}
+}
+
+func (game *Game) countEnemyKnightsOnOurHalf() int {
+	count := 0
+	for _, unit := range game.enemyUnits {
+		if unit.unitType == Knight && unit.position.distanceTo(game.myQueenStartingPosition) < unit.position.distanceTo(game.enemyQueenStartingPosition) {
+			count++
+		}
+	}
+	return count
+}
+
+// queueArchers Queues enough Archers for the Knights on our half, once we have an Archer barracks to train them.
+func (game *Game) queueArchers() {
+	if game.countStructures(ArcherBarracks) == 0 {
+		return
+	}
+	needed := (game.countEnemyKnightsOnOurHalf() + KnightsPerArcher - 1) / KnightsPerArcher
+	archers := game.numberOfMyUnits[Archer]
+	for _, queued := range game.unitBuildQueue {
+		if queued == Archer {
+			archers += ArchersPerTraining
+		}
+	}
+	if archers < needed && game.remainingGold >= ArcherCost {
+		game.queueUnits(Archer)
+	}
+}
+
+/************************************************
+Knight Wave Methods
+*************************************************/
+
+// planKnightWave Works out how many Knights the enemy towers on the way to the enemy queen will kill,
+// and how many batches it takes to get WaveSurvivors past them. Every batch needs its own barracks to spawn together.
+func (game *Game) planKnightWave() KnightWave {
+	from := game.myQueenStartingPosition
+	siteID, _ := game.sites.findClosestSiteID(game.enemyQueen.position, true, false, false, true, false, false, false, false)
+	if siteID != -1 {
+		from = game.sites[siteID].position
+	}
+
+	// Towers shoot one Knight at a time, for as long as the wave is in range
+	towerDamage := 0
+	for _, tower := range game.enemyTowers {
+		length := segmentLengthInCircle(from, game.enemyQueen.position, tower.position, float64(tower.param2))
+		if length == 0 {
+			continue
+		}
+		turnsInRange := getTurnsToTravel(length, KnightSpeed)
+		// On average the Knights are halfway into the range
+		towerDamage += turnsInRange * (TowerCreepDamage + tower.param2/400)
+	}
+	killed := getTurnsToTravel(float64(towerDamage), KnightHealth)
+
+	wave := KnightWave{knights: killed + WaveSurvivors}
+	wave.batches = getTurnsToTravel(float64(wave.knights), KnightsPerTraining)
+	wave.gold = wave.batches * KnightCost
+	return wave
+}
+
+// queueKnightWave Saves up until the whole wave can be trained at once, from barracks that are all free.
+// A wave that needs more barracks than we have waits for them, see getLimits.
+func (game *Game) queueKnightWave() {
+	wave := game.planKnightWave()
+	freeBarracks := len(game.findFreeBarracks(Knight))
+	fmt.Fprintln(os.Stderr, "Knight wave:", wave.knights, "knights in", wave.batches, "batches for", wave.gold, "gold, free barracks", freeBarracks)
+	if game.remainingGold < wave.gold || freeBarracks < wave.batches {
+		return
+	}
+	for i := 0; i < wave.batches; i++ {
+		game.queueUnits(Knight)
+	}
+}
+
+/************************************************
+Contested Site Methods
+*************************************************/
+
+// analyzeContestedSites Finds the neutral midfield sites both queens can reach at about the same time.
+// Sites we reach first and that aren't under enemy tower fire can be held: a Tower when the enemy is close
+// behind, a mine when we have time. Sites the enemy gets to first, or we can't hold, are skipped.
+func (game *Game) analyzeContestedSites() map[int]ContestedSite {
+	contestedSites := map[int]ContestedSite{}
+	for _, site := range game.sites {
+		if site.owner != Neutral || math.Abs(float64(site.position.x-FieldWidth/2)) > ContestedMidfield {
+			continue
+		}
+		contested := ContestedSite{
+			myArrival:    getTurnsToTravel(float64(site.distanceFromMyQueen-site.radius-QueenRadius), QueenSpeed),
+			enemyArrival: getTurnsToTravel(float64(site.distanceFromEnemyQueen-site.radius-QueenRadius), QueenSpeed),
+		}
+		if absInt(contested.myArrival-contested.enemyArrival) > ContestedTurns {
+			continue
+		}
+		contested.canHold = contested.myArrival < contested.enemyArrival && !game.isInEnemyTowerRange(site.position)
+		contested.claimAs = SkipSite
+		if contested.canHold {
+			contested.claimAs = Tower
+			if site.ID == game.enemyIntent.targetSiteID {
+				// She's racing us for it, claim it quickly
+				fmt.Fprintln(os.Stderr, "Race enemy queen to site", site.ID)
+				contestedSites[site.ID] = contested
+				continue
+			}
+			if contested.enemyArrival-contested.myArrival >= ContestedTurns && !site.isDepleted() {
+				contested.claimAs = Goldmine
+			}
+		}
+		fmt.Fprintln(os.Stderr, "Contested site", site.ID, "arrival", contested.myArrival, "vs", contested.enemyArrival, "claim as", contested.claimAs)
+		contestedSites[site.ID] = contested
+	}
+	return contestedSites
+}
+
+/************************************************
+Sabotage Methods
+*************************************************/
+
+// getSabotageValue What replacing the enemy mine or barracks with our own structure gains us, in gold,
+// minus the turns it takes to get there. 0 when it can't be reached safely.
+func (game *Game) getSabotageValue(site *Site) int {
+	if site.owner != Enemy || site.getStructureType() == Tower {
+		return 0
+	}
+	if game.areEnemyUnitsNear(site.position) {
+		return 0
+	}
+	for _, tower := range game.enemyTowers {
+		if segmentIntersectsCircle(game.myQueen.position, site.position, tower.position, float64(tower.param2)) {
+			return 0
+		}
+	}
+
+	turnsLeft := MaxTurns - game.turn
+	value := SabotageBarracksValue
+	if site.getStructureType() == Goldmine {
+		// They lose their income, we get a fresh mine's. The enemy's income is hidden, so assume they upgraded
+		// it as far as it goes.
+		gold := site.goldRemaining
+		if gold == -1 {
+			gold = UnknownMineGold
+		}
+		enemyRate := maxInt(site.maxMineSize, MineIncome)
+		enemyIncome := minInt(gold, enemyRate*turnsLeft)
+		ourIncome := minInt(gold, MineIncome*turnsLeft)
+		value = enemyIncome + ourIncome
+	}
+	travel := getTurnsToTravel(float64(site.distanceFromMyQueen), QueenSpeed)
+	return maxInt(0, value-travel*QueenTurnValue)
+}
+
+/************************************************
+Mine Upgrade Methods
+*************************************************/
+
+// shouldUpgradeMine Does one more upgrade pay back before the mine runs dry or the game ends?
+// The extra income is weighed against the turn the queen stands still and the risk of standing there.
+func (game *Game) shouldUpgradeMine(site *Site) bool {
+	turnsLeft := MaxTurns - game.turn
+	rate := site.param1
+	extraIncome := minInt(site.goldRemaining, (rate+1)*turnsLeft) - minInt(site.goldRemaining, rate*turnsLeft)
+
+	cost := QueenTurnValue
+	turnsToImpact, threatDamage := game.getQueenThreat()
+	if turnsToImpact <= 1 {
+		cost += threatDamage * QueenHealthValue
+	}
+	for _, tower := range game.enemyTowers {
+		if site.position.isInCircle(tower.position, float64(tower.param2)) {
+			cost += (TowerQueenDamage + tower.param2/400) * QueenHealthValue
+		}
+	}
+
+	fmt.Fprintln(os.Stderr, "Mine upgrade", site.ID, "extra income", extraIncome, "cost", cost)
+	return extraIncome > cost
+}
+
+/************************************************
+Tower Placement Methods
+*************************************************/
+
+// getApproachPoints Points on the lanes enemy units take: from the enemy barracks (or the enemy queen's side)
+// to our mines and our queen.
+func (game *Game) getApproachPoints() []Position {
+	sources := []Position{}
+	for _, site := range game.sites {
+		if site.owner == Enemy && (site.getStructureType() == Barracks || site.getStructureType() == GiantBarracks) {
+			sources = append(sources, site.position)
+		}
+	}
+	if len(sources) == 0 {
+		sources = append(sources, game.opponent.getTypicalQueenPosition())
+	}
+	targets := []Position{game.myQueen.position}
+	for _, site := range game.sites {
+		if site.owner == Friendly && site.getStructureType() == Goldmine {
+			targets = append(targets, site.position)
+		}
+	}
+
+	points := []Position{}
+	for _, source := range sources {
+		for _, target := range targets {
+			length := source.distanceTo(target)
+			for distance := 0.0; distance <= length; distance += ApproachPointStep {
+				points = append(points, source.towards(target, distance))
+			}
+		}
+	}
+	return points
+}
+
+// scoreTowerPlacement How much of the approach lanes a Tower on the site covers once it's grown to
+// MinTowerRangeConstruction, out of TowerCoverageScore. Lanes already covered by our towers count for less, and towers far from our
+// mines cost more trips to keep them up.
+func (game *Game) scoreTowerPlacement(site *Site) float64 {
+	towers := game.sites.findTowers(Friendly)
+	score := 0.0
+	for _, point := range game.approachPoints {
+		if !point.isInCircle(site.position, MinTowerRangeConstruction) {
+			continue
+		}
+		covered := false
+		for _, tower := range towers {
+			if point.isInCircle(tower.position, float64(tower.param2)) {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			score += 0.25
+		} else {
+			score += 1
+		}
+	}
+	// A share of the lanes, so more enemy barracks and more mines don't make every Tower look better
+	if len(game.approachPoints) > 0 {
+		score = score / float64(len(game.approachPoints)) * TowerCoverageScore
+	}
+	// Upkeep trips start from home
+	score -= float64(site.distanceFromStartingLocation) / 40
+	return score
+}
+
+/************************************************
+Barracks Placement Methods
+*************************************************/
+
+// scoreBarracksPlacement Attacking barracks belong close to where the enemy queen usually is, out of reach of enemy towers.
+// Doesn't include the queen's travel cost, so it can compare with barracks we already have.
+func (game *Game) scoreBarracksPlacement(site *Site) float64 {
+	typical := game.opponent.getTypicalQueenPosition()
+	score := float64(FieldWidth)/50 - site.position.distanceTo(typical)/50
+	score -= float64(game.sites.countTowersCovering(site.position, Enemy) * 40)
+	return score
+}
+
+// updateBarracksRelocation When the front has moved, and a buildable site is much better placed than one of our
+// Knight barracks, plan to build a new barracks on the best one and turn the old one into a Tower.
+func (game *Game) updateBarracksRelocation() {
+	if game.relocation != nil {
+		from := game.sites[game.relocation.fromSiteID]
+		to := game.sites[game.relocation.toSiteID]
+		if from.owner != Friendly || from.getStructureType() != Barracks || (to.owner != Neutral && !game.relocation.isDone(game)) {
+			fmt.Fprintln(os.Stderr, "Barracks relocation from", from.ID, "to", to.ID, "finished")
+			game.relocation = nil
+		}
+		return
+	}
+	if game.phase < MidGamePhase {
+		return
+	}
+	// Sites in ID order, so the same turn always picks the same relocation
+	sites := returnSortedByID(game.sites)
+	var best *Relocation
+	bestGain := RelocateMargin
+	for _, barracksAndID := range sites {
+		barracks := game.sites[barracksAndID.ID]
+		if barracks.owner != Friendly || barracks.getStructureType() != Barracks {
+			continue
+		}
+		current := game.scoreBarracksPlacement(barracks)
+		for _, siteAndID := range sites {
+			site := game.sites[siteAndID.ID]
+			// Only free sites, taking over an enemy one would end the relocation as soon as it starts
+			if site.owner != Neutral || !game.canBuildOn(site, Barracks) {
+				continue
+			}
+			gain := game.scoreBarracksPlacement(site) - float64(site.distanceFromMyQueen)/RelocateTravelCost - current
+			if gain > bestGain {
+				best = &Relocation{
+					fromSiteID: barracks.ID,
+					toSiteID:   site.ID,
+				}
+				bestGain = gain
+			}
+		}
+	}
+	if best != nil {
+		fmt.Fprintln(os.Stderr, "Relocate barracks from", best.fromSiteID, "to", best.toSiteID)
+		game.relocation = best
+	}
+}
+
+// isDone Is the new barracks built?
+func (relocation *Relocation) isDone(game *Game) bool {
+	to := game.sites[relocation.toSiteID]
+	return to.owner == Friendly && to.getStructureType() == Barracks
+}
+
+/************************************************
+Enemy Queen Intent Methods
+*************************************************/
+
+// update Records the enemy queen's position, then works out where she's heading.
+func (intent *EnemyQueenIntent) update(position Position, sites Sites) {
+	intent.trajectory = append(intent.trajectory, position)
+	if len(intent.trajectory) > IntentHistory {
+		intent.trajectory = intent.trajectory[1:]
+	}
+
+	intent.likelyStructure = Goldmine
+	for structureType, count := range intent.builtStructures {
+		if count > intent.builtStructures[intent.likelyStructure] {
+			intent.likelyStructure = structureType
+		}
+	}
+
+	intent.targetSiteID = intent.findTargetSite(sites)
+	if intent.targetSiteID != -1 {
+		fmt.Fprintln(os.Stderr, "Enemy queen heading to site", intent.targetSiteID, "to build", intent.likelyStructure)
+	}
+}
+
+// recordBuilt Remembers what the enemy queen likes to build
+func (intent *EnemyQueenIntent) recordBuilt(event Event) {
+	if event.owner == Enemy {
+		intent.builtStructures[event.structureType]++
+	}
+}
+
+func (intent *EnemyQueenIntent) getVelocity() Position {
+	if len(intent.trajectory) < 2 {
+		return Position{}
+	}
+	return intent.trajectory[len(intent.trajectory)-1].subtract(intent.trajectory[len(intent.trajectory)-2])
+}
+
+// findTargetSite The site the enemy queen is walking straight at, and the closest of those. -1 when she's standing still
+// or isn't heading to any site we could care about.
+func (intent *EnemyQueenIntent) findTargetSite(sites Sites) int {
+	velocity := intent.getVelocity()
+	speed := velocity.length()
+	if speed == 0 {
+		return -1
+	}
+	position := intent.trajectory[len(intent.trajectory)-1]
+	targetSiteID := -1
+	closest := math.MaxFloat64
+	for _, site := range sites {
+		if site.owner == Enemy && site.getStructureType() != Goldmine {
+			continue
+		}
+		direction := site.position.subtract(position)
+		distance := direction.length()
+		if distance == 0 {
+			continue
+		}
+		alignment := float64(velocity.dot(direction)) / (speed * distance)
+		if alignment >= IntentMinAlignment && distance < closest {
+			targetSiteID = site.ID
+			closest = distance
+		}
+	}
+	return targetSiteID
+}
+
+// predictPosition Where the enemy queen will be after the turns: at the site she's heading to, otherwise further along her way.
+func (intent *EnemyQueenIntent) predictPosition(turns int, sites Sites) Position {
+	if len(intent.trajectory) == 0 {
+		return Position{}
+	}
+	position := intent.trajectory[len(intent.trajectory)-1]
+	if intent.targetSiteID != -1 {
+		target := sites[intent.targetSiteID]
+		// She stops when she touches the site
+		stop := target.position.towards(position, float64(target.radius+QueenRadius))
+		for turn := 0; turn < turns; turn++ {
+			position = position.step(stop, QueenSpeed)
+		}
+		return position
+	}
+	return position.add(intent.getVelocity().scale(float64(turns))).clampToField()
+}
+
+/************************************************
+Opponent Model Methods
+*************************************************/
+
+// observe Records the enemy's structures, units and queen position of this turn.
+func (opponent *OpponentModel) observe(game *Game) {
+	opponent.turnsObserved++
+	opponent.maxTowers = maxInt(opponent.maxTowers, game.sites.countStructures(Enemy, Tower))
+	opponent.maxGoldMines = maxInt(opponent.maxGoldMines, game.sites.countStructures(Enemy, Goldmine))
+	opponent.maxKnightBarracks = maxInt(opponent.maxKnightBarracks, game.sites.countStructures(Enemy, Barracks))
+	opponent.maxGiantBarracks = maxInt(opponent.maxGiantBarracks, game.sites.countStructures(Enemy, GiantBarracks))
+	opponent.maxArcherBarracks = maxInt(opponent.maxArcherBarracks, game.sites.countStructures(Enemy, ArcherBarracks))
+	if opponent.firstBarracksTurn == 0 && opponent.maxKnightBarracks > 0 {
+		opponent.firstBarracksTurn = game.turn
+	}
+	for _, unit := range game.enemyUnits {
+		opponent.unitTurnsSeen[unit.unitType]++
+	}
+	if distanceBetween(game.enemyQueen.position, game.myQueenStartingPosition) < distanceBetween(game.enemyQueen.position, game.enemyQueenStartingPosition) {
+		opponent.queenTurnsInOurHalf++
+	}
+	opponent.queenPositionTotal = opponent.queenPositionTotal.add(game.enemyQueen.position)
+}
+
+// getTypicalQueenPosition Where the enemy queen has been on average
+func (opponent *OpponentModel) getTypicalQueenPosition() Position {
+	if opponent.turnsObserved == 0 {
+		return opponent.queenPositionTotal
+	}
+	return opponent.queenPositionTotal.scale(1 / float64(opponent.turnsObserved))
+}
+
+// classify Scores every opponent type between 0 and 1, the best one becomes the label and its score the confidence.
+func (opponent *OpponentModel) classify() {
+	unitTurns := opponent.unitTurnsSeen[Knight] + opponent.unitTurnsSeen[Archer] + opponent.unitTurnsSeen[Giant]
+	share := func(unitType int) float64 {
+		if unitTurns == 0 {
+			return 0
+		}
+		return float64(opponent.unitTurnsSeen[unitType]) / float64(unitTurns)
+	}
+	aggression := 0.0
+	if opponent.turnsObserved > 0 {
+		aggression = float64(opponent.queenTurnsInOurHalf) / float64(opponent.turnsObserved)
+	}
+
+	scores := map[int]float64{}
+	if opponent.firstBarracksTurn > 0 && opponent.firstBarracksTurn < EarlyBarracksTurn {
+		scores[KnightRushOpponent] = 0.5 + 0.3*share(Knight) + 0.2*aggression
+	}
+	if opponent.maxTowers > MaxTowers {
+		// Staying home only counts when it comes with the towers
+		towers := math.Min(float64(opponent.maxTowers-MaxTowers)/TurtleExtraTowers, 1)
+		scores[TowerTurtleOpponent] = towers * (0.7 + 0.3*(1-aggression))
+	}
+	if opponent.maxGiantBarracks > 0 {
+		scores[GiantPushOpponent] = 0.6 + 0.4*share(Giant)
+	}
+	if opponent.maxArcherBarracks > 0 {
+		scores[ArcherDefenseOpponent] = 0.6 + 0.4*share(Archer)
+	}
+	if opponent.maxKnightBarracks == 0 && opponent.maxGiantBarracks == 0 && opponent.maxArcherBarracks == 0 {
+		scores[MineGreedOpponent] = math.Min(float64(opponent.maxGoldMines)/5, 1)
+	}
+
+	opponent.label = UnknownOpponent
+	opponent.confidence = 0
+	for _, label := range []int{KnightRushOpponent, TowerTurtleOpponent, GiantPushOpponent, ArcherDefenseOpponent, MineGreedOpponent} {
+		if scores[label] > opponent.confidence {
+			opponent.label = label
+			opponent.confidence = scores[label]
+		}
+	}
+}
+
+func getOpponentName(label int) string {
+	switch label {
+	case KnightRushOpponent:
+		return "knight rush"
+	case TowerTurtleOpponent:
+		return "tower turtle"
+	case GiantPushOpponent:
+		return "giant push"
+	case ArcherDefenseOpponent:
+		return "archer defense"
+	case MineGreedOpponent:
+		return "mine greed"
+	}
+	return "unknown"
+}
+
+/************************************************
+Event Methods
+*************************************************/
+
+// subscribe Calls the handler for every event of the type, or for every event with AllEvents
+func (bus *EventBus) subscribe(eventType int, handler func(Event)) {
+	bus.subscribers[eventType] = append(bus.subscribers[eventType], handler)
+}
+
+func (bus *EventBus) publish(event Event) {
+	for _, handler := range bus.subscribers[event.eventType] {
+		handler(event)
+	}
+	for _, handler := range bus.subscribers[AllEvents] {
+		handler(event)
+	}
+}
+
+// diff Compares this turn's sites, units and queens with last turn's and publishes what changed.
+// Units are matched by the IDs the UnitTracker gave them. Sites we haven't seen yet count as empty.
+func (bus *EventBus) diff(game *Game) {
+	for ID, site := range game.sites {
+		previous, ok := bus.previousSites[ID]
+		if !ok {
+			previous = Site{ID: ID, owner: Neutral, structureType: NoStructure}
+		}
+		bus.diffSite(game.turn, previous, *site)
+		bus.previousSites[ID] = *site
+	}
+
+	units := map[int]Unit{}
+	for _, unit := range append(append([]Unit{}, game.myUnits...), game.enemyUnits...) {
+		units[unit.ID] = unit
+		if _, ok := bus.previousUnits[unit.ID]; !ok {
+			bus.publish(Event{eventType: UnitSpawnedEvent, turn: game.turn, siteID: -1, owner: unit.owner, unit: unit})
+		}
+	}
+	for ID, unit := range bus.previousUnits {
+		if _, ok := units[ID]; !ok {
+			bus.publish(Event{eventType: UnitDiedEvent, turn: game.turn, siteID: -1, owner: unit.owner, unit: unit})
+		}
+	}
+	bus.previousUnits = units
+
+	for _, queen := range []Unit{game.myQueen, game.enemyQueen} {
+		if previous, ok := bus.previousQueens[queen.owner]; ok && queen.health < previous.health {
+			bus.publish(Event{eventType: QueenDamagedEvent, turn: game.turn, siteID: -1, owner: queen.owner, unit: queen, amount: previous.health - queen.health})
+		}
+		bus.previousQueens[queen.owner] = queen
+	}
+}
+
+func (bus *EventBus) diffSite(turn int, previous Site, site Site) {
+	event := Event{turn: turn, siteID: site.ID}
+	publish := func(eventType int, owner int, structureType int, amount int) {
+		event.eventType = eventType
+		event.owner = owner
+		event.structureType = structureType
+		event.amount = amount
+		bus.publish(event)
+	}
+	previousType := previous.getStructureType()
+	structureType := site.getStructureType()
+	changed := previous.owner != site.owner || previousType != structureType
+
+	if changed && previousType != NoStructure {
+		publish(StructureDestroyedEvent, previous.owner, previousType, 0)
+	}
+	if previous.owner != site.owner && previous.owner != Neutral {
+		publish(SiteLostEvent, previous.owner, previousType, 0)
+	}
+	if previous.owner != site.owner && site.owner != Neutral {
+		publish(SiteClaimedEvent, site.owner, structureType, 0)
+	}
+	if changed && structureType != NoStructure {
+		publish(StructureBuiltEvent, site.owner, structureType, 0)
+	}
+	// Mines make more gold, towers get more health
+	if !changed && (structureType == Goldmine || structureType == Tower) && site.param1 > previous.param1 {
+		publish(StructureUpgradedEvent, site.owner, structureType, site.param1-previous.param1)
+	}
+	if previous.goldRemaining > 0 && site.goldRemaining == 0 {
+		publish(MineDepletedEvent, site.owner, structureType, 0)
+	}
+}
+
+func logEvent(event Event) {
+	fmt.Fprintln(os.Stderr, "Event", getEventName(event.eventType), "turn", event.turn, "site", event.siteID, "owner", event.owner, "structure", event.structureType, "amount", event.amount)
+}
+
+func getEventName(eventType int) string {
+	switch eventType {
+	case SiteClaimedEvent:
+		return "site claimed"
+	case SiteLostEvent:
+		return "site lost"
+	case StructureBuiltEvent:
+		return "structure built"
+	case StructureDestroyedEvent:
+		return "structure destroyed"
+	case StructureUpgradedEvent:
+		return "structure upgraded"
+	case UnitSpawnedEvent:
+		return "unit spawned"
+	case UnitDiedEvent:
+		return "unit died"
+	case QueenDamagedEvent:
+		return "queen damaged"
+	case MineDepletedEvent:
+		return "mine depleted"
+	}
+	return "unknown"
+}
+
+/************************************************
+Unit Tracker Methods
+*************************************************/
+
+// update Matches this turn's units with last turn's. A unit can only be one of the same owner and type
+// that was within a turn of movement and had at least as much health. Closest pairs are matched first,
+// what's left over has spawned or died.
+func (tracker *UnitTracker) update(turn int, unitLists ...[]Unit) {
+	type pair struct {
+		list     int
+		index    int
+		ID       int
+		distance float64
+	}
+	pairs := []pair{}
+	for list, units := range unitLists {
+		for index, unit := range units {
+			for ID, tracked := range tracker.units {
+				previous := tracked.unit
+				distance := previous.position.distanceTo(unit.position)
+				if previous.owner == unit.owner && previous.unitType == unit.unitType &&
+					unit.health <= previous.health && distance <= float64(getUnitSpeed(unit.unitType)+QueenRadius) {
+					pairs = append(pairs, pair{list, index, ID, distance})
+				}
+			}
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool {
+		return pairs[i].distance < pairs[j].distance
+	})
+
+	matchedUnits := map[[2]int]bool{}
+	for _, pair := range pairs {
+		tracked := tracker.units[pair.ID]
+		if matchedUnits[[2]int{pair.list, pair.index}] || tracked.lastSeenTurn == turn {
+			continue
+		}
+		matchedUnits[[2]int{pair.list, pair.index}] = true
+		unit := &unitLists[pair.list][pair.index]
+		unit.ID = pair.ID
+		tracked.unit = *unit
+		tracked.lastSeenTurn = turn
+		tracked.healthHistory = append(tracked.healthHistory, unit.health)
+	}
+
+	for list, units := range unitLists {
+		for index := range units {
+			if matchedUnits[[2]int{list, index}] {
+				continue
+			}
+			tracker.nextID++
+			unit := &unitLists[list][index]
+			unit.ID = tracker.nextID
+			tracker.units[unit.ID] = &TrackedUnit{
+				unit:          *unit,
+				spawnTurn:     turn,
+				lastSeenTurn:  turn,
+				healthHistory: []int{unit.health},
+			}
+		}
+	}
+
+	for ID, tracked := range tracker.units {
+		if tracked.lastSeenTurn != turn {
+			delete(tracker.units, ID)
+		}
+	}
+}
+
+// getRemainingLifetime How many turns until the unit has decayed, going by how fast it has been losing health
+func (tracked *TrackedUnit) getRemainingLifetime() int {
+	lossPerTurn := float64(UnitDecay)
+	turns := len(tracked.healthHistory) - 1
+	if turns > 0 {
+		lost := tracked.healthHistory[0] - tracked.healthHistory[turns]
+		lossPerTurn = math.Max(lossPerTurn, float64(lost)/float64(turns))
+	}
+	return int(float64(tracked.unit.health) / lossPerTurn)
+}
+
+// countExpiring How many units of the owner and type will have decayed within the turns
+func (tracker *UnitTracker) countExpiring(owner int, unitType int, turns int) int {
+	count := 0
+	for _, tracked := range tracker.units {
+		if tracked.unit.owner == owner && tracked.unit.unitType == unitType && tracked.getRemainingLifetime() <= turns {
+			count++
+		}
+	}
+	return count
+}
+
+/************************************************
+Limits
+*************************************************/
+
+// getLimits The Max* values, adjusted for the strategy and how far the game is.
+func (game *Game) getLimits() Limits {
+	limits := Limits{
+		knightBarracks: MaxKnightBarracks,
+		giantBarracks:  0,
+		archerBarracks: MaxArcherBarracks,
+		goldMines:      MaxGoldMines,
+		towers:         MaxTowers,
+		knights:        MaxKnights,
+		archers:        MaxArcher,
+		giants:         0,
+	}
+	if game.strategy == TooManyTowersStrategy {
+		limits.giantBarracks = MaxGiantBarracks
+		limits.giants = MaxGiants
+	}
+	if game.strategy == RushDefenseStrategy {
+		limits.towers += 2
+	}
+	if game.defenseMode {
+		limits.archerBarracks = maxInt(MaxArcherBarracks, 1)
+	}
+	if game.strategy == DefaultStrategy || game.strategy == RushDefenseStrategy {
+		// Enough barracks to spawn the Knight wave together, as far as the Knights cap allows
+		limits.knightBarracks = maxInt(limits.knightBarracks, minInt(game.planKnightWave().batches, MaxKnights/KnightsPerTraining))
+	}
+	if game.relocation != nil {
+		// Room for the new barracks, and then for the Tower replacing the old one
+		limits.knightBarracks++
+		if game.relocation.isDone(game) {
+			limits.towers++
+		}
+	}
+	switch game.phase {
+	case OpeningPhase:
+		// Get the economy going first, one tower is enough to panic to
+		if game.strategy != RushDefenseStrategy {
+			limits.towers = 1
+		}
+		if game.opponent.label != MineGreedOpponent || game.opponent.confidence < OpponentConfidence {
+			// Unless the enemy is greedy, then punish it with an early Knight attack
+			limits.knightBarracks = 0
+			limits.knights = 0
+		}
+	case EndGamePhase:
+		// The mines are running dry and the enemy queen has to be finished off
+		limits.goldMines = game.countStructures(Goldmine)
+		limits.towers++
+		limits.knights += KnightsPerTraining
+	}
+	if game.endgameMode == PressureQueenMode {
+		limits.knights += KnightsPerTraining * 2
+	}
+	return limits
+}
+
+func (limits Limits) forStructure(structureType int) int {
+	switch structureType {
+	case Goldmine:
+		return limits.goldMines
+	case Tower:
+		return limits.towers
+	case Barracks:
+		return limits.knightBarracks
+	case GiantBarracks:
+		return limits.giantBarracks
+	case ArcherBarracks:
+		return limits.archerBarracks
+	}
+	return 0
+}
+
+func (limits Limits) forUnit(unitType int) int {
+	switch unitType {
+	case Knight:
+		return limits.knights
+	case Archer:
+		return limits.archers
+	case Giant:
+		return limits.giants
+	}
+	return 0
+}
+
+// isStructureCapped Do we already own as many of the structure type as we want?
+func (game *Game) isStructureCapped(structureType int) bool {
+	count := game.countStructures(structureType)
+	limit := game.limits.forStructure(structureType)
+	if count >= limit {
+		if limit > 0 {
+			fmt.Fprintln(os.Stderr, "Cap reached for structure", structureType, count, "/", limit)
+		}
+		return true
+	}
+	return false
+}
+
+// isUnitCapped Would training another batch of the unit type bring us over the limit? Counts queued units as well.
+func (game *Game) isUnitCapped(unitType int) bool {
+	// Units that have decayed before the new ones are trained don't count
+	count := game.numberOfMyUnits[unitType] - game.tracker.countExpiring(Friendly, unitType, getTrainTurns(unitType))
+	for _, queued := range game.unitBuildQueue {
+		if queued == unitType {
+			count += getUnitsPerTraining(unitType)
+		}
+	}
+	limit := game.limits.forUnit(unitType)
+	if count+getUnitsPerTraining(unitType) > limit {
+		fmt.Fprintln(os.Stderr, "Cap reached for unit", unitType, count, "/", limit)
+		return true
+	}
+	return false
+}
+
+/************************************************
+Snapshot Methods
+*************************************************/
+
+// snapshot Captures the game state of the turn, with everything we remember from earlier turns,
+// so loadGame plays the turn exactly like it was played.
+func (game *Game) snapshot() GameSnapshot {
+	snapshot := GameSnapshot{
+		Turn:                       game.turn,
+		Gold:                       game.gold,
+		TouchedSite:                game.touchedSite,
+		Strategy:                   game.strategy,
+		Phase:                      game.phase,
+		Mirrored:                   game.mirrored,
+		StartingHealth:             game.startingHealth,
+		MyQueenStartingPosition:    PositionSnapshot{game.myQueenStartingPosition.x, game.myQueenStartingPosition.y},
+		EnemyQueenStartingPosition: PositionSnapshot{game.enemyQueenStartingPosition.x, game.enemyQueenStartingPosition.y},
+		NumberOfTowers:             game.numberOfTowers,
+		NumberOfBarracks:           map[int]int{},
+		UnitBuildQueue:             append([]int{}, game.unitBuildQueue...),
+		MyQueen:                    newUnitSnapshot(game.myQueen),
+		EnemyQueen:                 newUnitSnapshot(game.enemyQueen),
+		Units:                      []UnitSnapshot{},
+		Sites:                      []SiteSnapshot{},
+	}
+	for unitType, count := range *game.numberOfBarracks {
+		snapshot.NumberOfBarracks[unitType] = count
+	}
+	for _, unit := range append(append([]Unit{}, game.myUnits...), game.enemyUnits...) {
+		snapshot.Units = append(snapshot.Units, newUnitSnapshot(unit))
+	}
+	for _, siteAndDistance := range returnSortedByID(game.sites) {
+		site := game.sites[siteAndDistance.ID]
+		snapshot.Sites = append(snapshot.Sites, SiteSnapshot{
+			ID:            site.ID,
+			X:             site.position.x,
+			Y:             site.position.y,
+			Radius:        site.radius,
+			StructureType: site.structureType,
+			Owner:         site.owner,
+			Param1:        site.param1,
+			Param2:        site.param2,
+			GoldRemaining: site.goldRemaining,
+			MaxMineSize:   site.maxMineSize,
+		})
+	}
+
+	snapshot.DefenseMode = game.defenseMode
+	snapshot.KnightPressure = append([]int{}, game.knightPressure...)
+	if game.buildTarget != nil {
+		snapshot.BuildTarget = &BuildTargetSnapshot{game.buildTarget.siteID, game.buildTarget.structureType, game.buildTarget.score}
+	}
+	opponent := game.opponent
+	snapshot.Opponent = &OpponentSnapshot{
+		TurnsObserved:       opponent.turnsObserved,
+		MaxTowers:           opponent.maxTowers,
+		MaxGoldMines:        opponent.maxGoldMines,
+		MaxKnightBarracks:   opponent.maxKnightBarracks,
+		MaxGiantBarracks:    opponent.maxGiantBarracks,
+		MaxArcherBarracks:   opponent.maxArcherBarracks,
+		FirstBarracksTurn:   opponent.firstBarracksTurn,
+		UnitTurnsSeen:       map[int]int{},
+		QueenTurnsInOurHalf: opponent.queenTurnsInOurHalf,
+		QueenPositionTotal:  PositionSnapshot{opponent.queenPositionTotal.x, opponent.queenPositionTotal.y},
+		Label:               opponent.label,
+		Confidence:          opponent.confidence,
+	}
+	for unitType, turns := range opponent.unitTurnsSeen {
+		snapshot.Opponent.UnitTurnsSeen[unitType] = turns
+	}
+	if plan := game.giantPlan; plan != nil {
+		snapshot.GiantPlan = &GiantPlanSnapshot{
+			TargetIDs:        append([]int{}, plan.targetIDs...),
+			BarracksSiteID:   plan.barracksSiteID,
+			KnightDelay:      plan.knightDelay,
+			WorthIt:          plan.worthIt,
+			GiantTrainedTurn: plan.giantTrainedTurn,
+			EscortQueued:     plan.escortQueued,
+		}
+	}
+	if game.relocation != nil {
+		snapshot.Relocation = &RelocationSnapshot{game.relocation.fromSiteID, game.relocation.toSiteID}
+	}
+	snapshot.Tracker = &TrackerSnapshot{NextID: game.tracker.nextID}
+	for ID := 1; ID <= game.tracker.nextID; ID++ {
+		if tracked, ok := game.tracker.units[ID]; ok {
+			snapshot.Tracker.Units = append(snapshot.Tracker.Units, TrackedUnitSnapshot{
+				Unit:          newUnitSnapshot(tracked.unit),
+				SpawnTurn:     tracked.spawnTurn,
+				LastSeenTurn:  tracked.lastSeenTurn,
+				HealthHistory: append([]int{}, tracked.healthHistory...),
+			})
+		}
+	}
+	intent := game.enemyIntent
+	snapshot.EnemyIntent = &IntentSnapshot{
+		TargetSiteID:    intent.targetSiteID,
+		LikelyStructure: intent.likelyStructure,
+		BuiltStructures: map[int]int{},
+	}
+	for _, position := range intent.trajectory {
+		snapshot.EnemyIntent.Trajectory = append(snapshot.EnemyIntent.Trajectory, PositionSnapshot{position.x, position.y})
+	}
+	for structureType, count := range intent.builtStructures {
+		snapshot.EnemyIntent.BuiltStructures[structureType] = count
+	}
+	return snapshot
+}
 
-	//if game.touchedSite != Neutral && game.sites[game.touchedSite].owner == Neutral {
-	if game.touchedSite != Neutral {
-		for order, siteAndDistance := range game.sitesOrderedByDistanceFromStart {
-			if order >= len(buildOrder) {
-				continue
+func (snapshot GameSnapshot) toJSON() string {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return err.Error()
+	}
+	return string(data)
+}
+
+// loadGame Builds a game from a JSON snapshot, ready for playTurn. Events are seeded with the snapshot's state,
+// so loading doesn't count every structure a second time.
+func loadGame(data []byte) (*Game, error) {
+	var snapshot GameSnapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+
+	game := newGame()
+	game.gold = snapshot.Gold
+	game.touchedSite = snapshot.TouchedSite
+	game.mirrored = snapshot.Mirrored
+	game.sites = make(Sites)
+	for _, siteSnapshot := range snapshot.Sites {
+		site := &Site{
+			ID:       siteSnapshot.ID,
+			position: Position{siteSnapshot.X, siteSnapshot.Y},
+			radius:   siteSnapshot.Radius,
+		}
+		game.sites[site.ID] = site
+		game.changeSite(site.ID, siteSnapshot.StructureType, siteSnapshot.Owner, siteSnapshot.Param1, siteSnapshot.Param2, siteSnapshot.GoldRemaining, siteSnapshot.MaxMineSize)
+		if site.owner == Enemy && site.getStructureType() == Tower {
+			game.enemyTowers[site.ID] = site
+		}
+		game.events.previousSites[site.ID] = *site
+	}
+	for _, unitSnapshot := range append([]UnitSnapshot{snapshot.MyQueen, snapshot.EnemyQueen}, snapshot.Units...) {
+		game.buildUnit(unitSnapshot.X, unitSnapshot.Y, unitSnapshot.Owner, unitSnapshot.UnitType, unitSnapshot.Health)
+	}
+	game.restore(snapshot)
+	return game, nil
+}
+
+// restore Brings back what earlier turns left behind, on top of the sites and units of the snapshot's turn.
+// What a snapshot leaves out starts fresh, like the tracker and the enemy queen's intent, which then only
+// know the snapshot's turn.
+func (game *Game) restore(snapshot GameSnapshot) {
+	game.turn = snapshot.Turn
+	game.strategy = snapshot.Strategy
+	game.phase = snapshot.Phase
+	game.startingHealth = snapshot.StartingHealth
+	game.myQueenStartingPosition = Position{snapshot.MyQueenStartingPosition.X, snapshot.MyQueenStartingPosition.Y}
+	game.enemyQueenStartingPosition = Position{snapshot.EnemyQueenStartingPosition.X, snapshot.EnemyQueenStartingPosition.Y}
+	game.numberOfTowers = snapshot.NumberOfTowers
+	game.numberOfBarracks = &BarracksCount{}
+	for unitType, count := range snapshot.NumberOfBarracks {
+		(*game.numberOfBarracks)[unitType] = count
+	}
+	game.unitBuildQueue = append([]int{}, snapshot.UnitBuildQueue...)
+	game.setSitesOrderedByDistanceFromStart()
+	game.sites.setDistancesFromQueens(game.myQueen, game.enemyQueen)
+
+	// The tracker and the intent might have seen the turn already, they're subscribed so reset them in place
+	*game.tracker = UnitTracker{units: map[int]*TrackedUnit{}}
+	*game.enemyIntent = EnemyQueenIntent{targetSiteID: -1, builtStructures: map[int]int{}}
+	if snapshot.Tracker != nil {
+		// Units keep their IDs, the tracker has already seen this turn
+		game.tracker.nextID = snapshot.Tracker.NextID
+		for _, trackedSnapshot := range snapshot.Tracker.Units {
+			game.tracker.units[trackedSnapshot.Unit.ID] = &TrackedUnit{
+				unit:          trackedSnapshot.Unit.toUnit(),
+				spawnTurn:     trackedSnapshot.SpawnTurn,
+				lastSeenTurn:  trackedSnapshot.LastSeenTurn,
+				healthHistory: append([]int{}, trackedSnapshot.HealthHistory...),
 			}
-			//fmt.Fprintln(os.Stderr, "Order", order, game.sitesOrderedByDistanceFromStart[order].ID)
-			//fmt.Fprintln(os.Stderr, "buildorder", buildOrder[order])
-			//fmt.Fprintln(os.Stderr, "ID", game.sites[game.sitesOrderedByDistanceFromStart[order].ID].ID)
-			if siteAndDistance.ID == game.touchedSite &&
-				game.sites[game.sitesOrderedByDistanceFromStart[order].ID].getStructureType() != buildOrder[order] {
-				if buildOrder[order] == Goldmine && (game.areEnemyUnitsNear(game.sites[game.touchedSite].position) || game.sites[game.touchedSite].goldRemaining <= IgnoreGoldmine) {
-					// If the gold has run out or enemies are near, build a Tower instead
-					fmt.Fprintln(os.Stderr, "Replace goldmine with Tower")
-					return game.getBuildCommand(game.touchedSite, Tower)
-				}
-				fmt.Fprintln(os.Stderr, "Build the build order on touched site, seeing:", game.sites[game.sitesOrderedByDistanceFromStart[order].ID].getStructureType(), "Building:", buildOrder[order])
-				return game.getBuildCommand(game.touchedSite, buildOrder[order])
+		}
+		myIndex, enemyIndex := 0, 0
+		for _, unitSnapshot := range snapshot.Units {
+			if unitSnapshot.Owner == Friendly {
+				game.myUnits[myIndex].ID = unitSnapshot.ID
+				myIndex++
+			} else {
+				game.enemyUnits[enemyIndex].ID = unitSnapshot.ID
+				enemyIndex++
 			}
 		}
+	} else {
+		game.tracker.update(game.turn, game.myUnits, game.enemyUnits)
 	}
+	game.events.previousUnits = map[int]Unit{}
+	for _, unit := range append(append([]Unit{}, game.myUnits...), game.enemyUnits...) {
+		game.events.previousUnits[unit.ID] = unit
+	}
+	game.events.previousQueens[Friendly] = game.myQueen
+	game.events.previousQueens[Enemy] = game.enemyQueen
 
-	// Upgrade mine logic
-	if game.touchedSite != Neutral &&
-		game.sites[game.touchedSite].owner == Friendly &&
-		game.sites[game.touchedSite].maxMineSize != game.sites[game.touchedSite].param1 &&
-		game.sites[game.touchedSite].getStructureType() == Goldmine &&
-		game.sites[game.touchedSite].goldRemaining > IgnoreGoldmine {
-		fmt.Fprintln(os.Stderr, "Upgrade Goldmine")
-		return game.getBuildCommand(game.touchedSite, Goldmine)
+	if snapshot.EnemyIntent != nil {
+		intent := game.enemyIntent
+		for _, position := range snapshot.EnemyIntent.Trajectory {
+			intent.trajectory = append(intent.trajectory, Position{position.X, position.Y})
+		}
+		intent.targetSiteID = snapshot.EnemyIntent.TargetSiteID
+		intent.likelyStructure = snapshot.EnemyIntent.LikelyStructure
+		for structureType, count := range snapshot.EnemyIntent.BuiltStructures {
+			intent.builtStructures[structureType] = count
+		}
+	} else {
+		game.enemyIntent.update(game.enemyQueen.position, game.sites)
 	}
 
-	// Upgrade Tower logic
-	if game.touchedSite != Neutral &&
-		game.sites[game.touchedSite].owner == Friendly &&
-		game.sites[game.touchedSite].getStructureType() == Tower &&
-		game.sites[game.touchedSite].param2 < MinTowerRangeConstruction {
-		fmt.Fprintln(os.Stderr, "Upgrade Tower")
-		return game.getBuildCommand(game.touchedSite, Tower)
+	game.defenseMode = snapshot.DefenseMode
+	game.knightPressure = append([]int{}, snapshot.KnightPressure...)
+	if target := snapshot.BuildTarget; target != nil {
+		game.buildTarget = &BuildCandidate{target.SiteID, target.StructureType, target.Score}
+	}
+	if opponent := snapshot.Opponent; opponent != nil {
+		game.opponent = &OpponentModel{
+			turnsObserved:       opponent.TurnsObserved,
+			maxTowers:           opponent.MaxTowers,
+			maxGoldMines:        opponent.MaxGoldMines,
+			maxKnightBarracks:   opponent.MaxKnightBarracks,
+			maxGiantBarracks:    opponent.MaxGiantBarracks,
+			maxArcherBarracks:   opponent.MaxArcherBarracks,
+			firstBarracksTurn:   opponent.FirstBarracksTurn,
+			unitTurnsSeen:       UnitCount{},
+			queenTurnsInOurHalf: opponent.QueenTurnsInOurHalf,
+			queenPositionTotal:  Position{opponent.QueenPositionTotal.X, opponent.QueenPositionTotal.Y},
+			label:               opponent.Label,
+			confidence:          opponent.Confidence,
+		}
+		for unitType, turns := range opponent.UnitTurnsSeen {
+			game.opponent.unitTurnsSeen[unitType] = turns
+		}
+	}
+	if plan := snapshot.GiantPlan; plan != nil {
+		game.giantPlan = &GiantPlan{
+			targetIDs:        append([]int{}, plan.TargetIDs...),
+			barracksSiteID:   plan.BarracksSiteID,
+			knightDelay:      plan.KnightDelay,
+			worthIt:          plan.WorthIt,
+			giantTrainedTurn: plan.GiantTrainedTurn,
+			escortQueued:     plan.EscortQueued,
+		}
+	}
+	if relocation := snapshot.Relocation; relocation != nil {
+		game.relocation = &Relocation{relocation.FromSiteID, relocation.ToSiteID}
+	}
+}
+
+// replaySnapshot Loads a snapshot dumped by the bot, and plays its turn again
+func replaySnapshot(file string) bool {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	game, err := loadGame([]byte(strings.TrimPrefix(strings.TrimSpace(string(data)), "Snapshot: ")))
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	queenAction, trainAction := game.playTurn(game.snapshot())
+	fmt.Println(queenAction)
+	fmt.Println(trainAction)
+	return true
+}
+
+func (unitSnapshot UnitSnapshot) toUnit() Unit {
+	return Unit{
+		ID:       unitSnapshot.ID,
+		position: Position{unitSnapshot.X, unitSnapshot.Y},
+		health:   unitSnapshot.Health,
+		owner:    unitSnapshot.Owner,
+		unitType: unitSnapshot.UnitType,
+	}
+}
+
+func newUnitSnapshot(unit Unit) UnitSnapshot {
+	return UnitSnapshot{
+		ID:       unit.ID,
+		X:        unit.position.x,
+		Y:        unit.position.y,
+		Health:   unit.health,
+		Owner:    unit.owner,
+		UnitType: unit.unitType,
 	}
+}
 
-	// Move to next build order location
-	for order := range buildOrder {
-		next := len(buildOrder) - 1 - order
-		targetSite := game.sites[game.sitesOrderedByDistanceFromStart[next].ID]
+/************************************************
+Puzzle Methods
+*************************************************/
 
-		fmt.Fprintln(os.Stderr, "compare structure type", targetSite.ID, targetSite.getStructureType(), buildOrder[next])
-		//if targetSite.owner != Friendly && targetSite.structureType != structureType {
-		if targetSite.getStructureType() != buildOrder[next] {
-			fmt.Fprintln(os.Stderr, "Move to next build order #", next)
-			return game.getMoveOrderForSite(targetSite)
+// runPuzzles Plays every puzzle in the directory, both as is and mirrored, and reports the failures.
+func runPuzzles(directory string) bool {
+	files, err := filepath.Glob(filepath.Join(directory, "*.json"))
+	if err != nil || len(files) == 0 {
+		fmt.Println("No puzzles found in", directory)
+		return false
+	}
+	sort.Strings(files)
+
+	failures := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			fmt.Println("FAIL", file, err)
+			failures++
+			continue
+		}
+		var puzzle Puzzle
+		if err := json.Unmarshal(data, &puzzle); err != nil {
+			fmt.Println("FAIL", file, err)
+			failures++
+			continue
+		}
+		// The mirrored game has to come out as the mirror of the first one
+		game, queenAction, trainAction := puzzle.play(false)
+		mirroredGame, mirroredQueenAction, mirroredTrainAction := puzzle.play(true)
+		results := map[string]string{
+			puzzle.Name:                 puzzle.Expect.check(game, queenAction, trainAction),
+			puzzle.Name + " (mirrored)": puzzle.Expect.check(mirroredGame, mirroredGame.toLocalAction(mirroredQueenAction), mirroredTrainAction),
+		}
+		if results[puzzle.Name+" (mirrored)"] == "" && (mirroredQueenAction != mirrorAction(queenAction) || mirroredTrainAction != trainAction) {
+			results[puzzle.Name+" (mirrored)"] = "did " + mirroredQueenAction + " " + mirroredTrainAction + ", expected the mirror of " + queenAction + " " + trainAction
+		}
+		for _, name := range []string{puzzle.Name, puzzle.Name + " (mirrored)"} {
+			if results[name] != "" {
+				fmt.Println("FAIL", name+":", results[name])
+				failures++
+			} else {
+				fmt.Println("PASS", name)
+			}
 		}
 	}
+	fmt.Println(len(files)*2-failures, "passed,", failures, "failed")
+	return failures == 0
+}
 
-	// Everything's done! Move to safety (aka your corner of the map)
-	fmt.Fprintln(os.Stderr, "Move to edge!")
-	return game.getMoveToEdge()
+// play Plays the puzzle's turn through the game's input, on the other side of the field when it's mirrored.
+func (puzzle Puzzle) play(mirrored bool) (game *Game, queenAction string, trainAction string) {
+	defer func() {
+		// Unlike in a real game a panic doesn't become a WAIT, a puzzle that panics fails
+		if err := recover(); err != nil {
+			queenAction = fmt.Sprint("PANIC ", err)
+			trainAction = ""
+		}
+	}()
+	snapshot := puzzle.Snapshot
+	game = newGame()
+	game.input = strings.NewReader(snapshot.toInput(mirrored))
+	game.readSites()
+	game.readTurn()
+	game.turn++
+	game.readTurn()
+	game.restore(snapshot)
+
+	queenAction, trainAction = game.decideTurn()
+	return game, queenAction, trainAction
 }
 
-func (game *Game) getBuildOrder() []int {
-	buildOrder := []int{Goldmine, Goldmine, Goldmine, Goldmine, Tower, Tower, Tower, Goldmine, Tower, Barracks}
-	// If the Goldmine has been emptied out, replace with a Tower
-	for order, structureType := range buildOrder {
-		if structureType == Goldmine && game.sites[game.sitesOrderedByDistanceFromStart[order].ID].goldRemaining <= IgnoreGoldmine {
-			buildOrder[order] = Tower
+// toInput The snapshot as the game's input: an opening turn with the queens on their starting positions,
+// which sets the frame, and then the snapshot's turn.
+func (snapshot GameSnapshot) toInput(mirrored bool) string {
+	toWorld := func(x int, y int) Position {
+		if mirrored {
+			return mirrorPosition(Position{x: x, y: y})
 		}
+		return Position{x: x, y: y}
+	}
+	var input strings.Builder
+	fmt.Fprintln(&input, len(snapshot.Sites))
+	for _, site := range snapshot.Sites {
+		position := toWorld(site.X, site.Y)
+		fmt.Fprintln(&input, site.ID, position.x, position.y, site.Radius)
 	}
 
-	if game.strategy == TooManyTowersStrategy {
-		buildOrder[0] = GiantBarracks
+	fmt.Fprintln(&input, snapshot.Gold, -1)
+	for _, site := range snapshot.Sites {
+		fmt.Fprintln(&input, site.ID, -1, -1, NoStructure, Neutral, -1, -1)
+	}
+	fmt.Fprintln(&input, 2)
+	for owner, start := range []PositionSnapshot{snapshot.MyQueenStartingPosition, snapshot.EnemyQueenStartingPosition} {
+		position := toWorld(start.X, start.Y)
+		fmt.Fprintln(&input, position.x, position.y, owner, Queen, snapshot.StartingHealth)
+	}
+
+	fmt.Fprintln(&input, snapshot.Gold, snapshot.TouchedSite)
+	for _, site := range snapshot.Sites {
+		structureType := site.StructureType
+		if isBarracks(structureType) {
+			structureType = Barracks
+		}
+		fmt.Fprintln(&input, site.ID, site.GoldRemaining, site.MaxMineSize, structureType, site.Owner, site.Param1, site.Param2)
 	}
-	return buildOrder
+	units := append([]UnitSnapshot{snapshot.MyQueen, snapshot.EnemyQueen}, snapshot.Units...)
+	fmt.Fprintln(&input, len(units))
+	for _, unit := range units {
+		position := toWorld(unit.X, unit.Y)
+		fmt.Fprintln(&input, position.x, position.y, unit.Owner, unit.UnitType, unit.Health)
+	}
+	return input.String()
 }
 
-func (game *Game) getMoveOrderForSite(site *Site) string {
-	return "MOVE " + strconv.Itoa(site.position.x) + " " + strconv.Itoa(site.position.y)
+// mirrorAction The same action on the other side of the field
+func mirrorAction(action string) string {
+	fields := strings.Fields(action)
+	if len(fields) != 3 || fields[0] != "MOVE" {
+		return action
+	}
+	x, _ := strconv.Atoi(fields[1])
+	y, _ := strconv.Atoi(fields[2])
+	position := mirrorPosition(Position{x: x, y: y})
+	return "MOVE " + strconv.Itoa(position.x) + " " + strconv.Itoa(position.y)
 }
 
-func (game *Game) getMoveToEdge() string {
-	edgePosition := game.findClosestEdge()
-	return "MOVE " + strconv.Itoa(edgePosition.x) + " " + strconv.Itoa(edgePosition.y)
+// toLocalAction Turns the position of a MOVE back into our (left side) frame
+func (game *Game) toLocalAction(action string) string {
+	fields := strings.Fields(action)
+	if len(fields) != 3 || fields[0] != "MOVE" {
+		return action
+	}
+	x, _ := strconv.Atoi(fields[1])
+	y, _ := strconv.Atoi(fields[2])
+	position := game.toLocal(Position{x: x, y: y})
+	return "MOVE " + strconv.Itoa(position.x) + " " + strconv.Itoa(position.y)
 }
 
-//func (game *Game) getMoveToClosestFriendlyTower() string {
-//closestSiteID, _ = game.sites.findClosestSiteID(game.myQueen.position.x, game.myQueen.position.y, true, false, false, false, true, false)
-//fmt.Fprintln(os.Stderr, "Moving to closest friendly tower!", closestSiteID)
-//}
+func (expect PuzzleExpectations) check(game *Game, queenAction string, trainAction string) string {
+	fields := strings.Fields(queenAction)
+	if fields[0] == "PANIC" {
+		return queenAction
+	}
+	if expect.QueenAction != "" && queenAction != expect.QueenAction {
+		return "queen did " + queenAction + ", expected " + expect.QueenAction
+	}
+	if expect.TrainAction != "" && trainAction != expect.TrainAction {
+		return "trained " + trainAction + ", expected " + expect.TrainAction
+	}
+	if expect.Builds != "" && (fields[0] != "BUILD" || fields[2] != expect.Builds) {
+		return "queen did " + queenAction + ", expected to build a " + expect.Builds
+	}
+	if expect.BuildSite != nil && (fields[0] != "BUILD" || fields[1] != strconv.Itoa(*expect.BuildSite)) {
+		return "queen did " + queenAction + ", expected to build on site " + strconv.Itoa(*expect.BuildSite)
+	}
 
-func (game *Game) findClosestEdge() Position {
-	x := 0
-	y := 0
-	if game.myQueenStartingPosition.x > (FieldWidth / 2) {
-		x = FieldWidth
-		y = FieldHeight
+	if fields[0] != "MOVE" {
+		if expect.MovesTowardSite != nil {
+			return "queen did " + queenAction + ", expected to move toward site " + strconv.Itoa(*expect.MovesTowardSite)
+		}
+		return ""
+	}
+	x, _ := strconv.Atoi(fields[1])
+	y, _ := strconv.Atoi(fields[2])
+	next := game.myQueen.position.step(Position{x: x, y: y}, QueenSpeed)
+	if expect.MovesTowardSite != nil {
+		site, ok := game.sites[*expect.MovesTowardSite]
+		if !ok || next.distanceTo(site.position) >= game.myQueen.position.distanceTo(site.position) {
+			return "queen did " + queenAction + ", expected to move toward site " + strconv.Itoa(*expect.MovesTowardSite)
+		}
 	}
+	if expect.AvoidsEnemyTowers {
+		for _, tower := range game.enemyTowers {
+			wasInRange := game.myQueen.position.isInCircle(tower.position, float64(tower.param2))
+			if next.isInCircle(tower.position, float64(tower.param2)) && !wasInRange {
+				return "queen did " + queenAction + ", walking into the range of enemy tower " + strconv.Itoa(tower.ID)
+			}
+		}
+	}
+	return ""
+}
 
-	return Position{
-		x: x,
-		y: y,
+/************************************************
+Frame Methods
+*************************************************/
+
+// setFrame Strategy code always plays from the left side. When our queen starts on the right,
+// every position is mirrored through the center of the field when it's read, and back when a command is written.
+func (game *Game) setFrame(units [][5]int) {
+	for _, unit := range units {
+		if unit[2] == Friendly && unit[3] == Queen {
+			game.mirrored = unit[0] > FieldWidth/2
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Mirrored:", game.mirrored)
+	for _, site := range game.sites {
+		site.position = game.toLocal(site.position)
+	}
+}
+
+// toLocal From the game's positions to our left side positions
+func (game *Game) toLocal(position Position) Position {
+	if !game.mirrored {
+		return position
 	}
+	return mirrorPosition(position)
+}
+
+// toWorld From our left side positions to the game's positions
+func (game *Game) toWorld(position Position) Position {
+	// Mirroring is its own inverse
+	return game.toLocal(position)
 }
 
 /************************************************
@@ -593,6 +3428,50 @@ func (sites Sites) findSiteIDs(owned bool, enemy bool, neutral bool) []int {
 	return IDs
 }
 
+func (sites Sites) findTowers(owner int) Sites {
+	towers := Sites{}
+	for id, site := range sites {
+		if site.owner == owner && site.getStructureType() == Tower {
+			towers[id] = site
+		}
+	}
+	return towers
+}
+
+// countTowersCovering How many Towers of the owner have the position in range
+func (sites Sites) countTowersCovering(position Position, owner int) int {
+	count := 0
+	for _, site := range sites {
+		if site.owner == owner && site.getStructureType() == Tower && position.isInCircle(site.position, float64(site.param2)) {
+			count++
+		}
+	}
+	return count
+}
+
+func (sites Sites) countStructures(owner int, structureType int) int {
+	count := 0
+	for _, site := range sites {
+		if site.owner == owner && site.getStructureType() == structureType {
+			count++
+		}
+	}
+	return count
+}
+
+// totalGoldRemaining Gold left in all sites we know of, and how many sites we know of
+func (sites Sites) totalGoldRemaining() (int, int) {
+	total := 0
+	known := 0
+	for _, site := range sites {
+		if site.goldRemaining != -1 {
+			total += site.goldRemaining
+			known++
+		}
+	}
+	return total, known
+}
+
 func (sites Sites) setDistancesFromQueens(myQueen Unit, enemyQueen Unit) {
 	for _, site := range sites {
 		distanceFromMyQueen := distanceBetween(myQueen.position, site.position)
@@ -650,6 +3529,149 @@ func (site Site) getStructureType() int {
 	return getRealStructureType(site.structureType, site.param2)
 }
 
+// isDepleted Is there (almost) no gold left? Unknown gold (-1) is not depleted.
+func (site Site) isDepleted() bool {
+	return site.goldRemaining != -1 && site.goldRemaining <= IgnoreGoldmine
+}
+
+/************************************************
+Position Methods
+*************************************************/
+
+func (position Position) add(other Position) Position {
+	return Position{
+		x: position.x + other.x,
+		y: position.y + other.y,
+	}
+}
+
+func (position Position) subtract(other Position) Position {
+	return Position{
+		x: position.x - other.x,
+		y: position.y - other.y,
+	}
+}
+
+func (position Position) scale(factor float64) Position {
+	return Position{
+		x: int(math.Round(float64(position.x) * factor)),
+		y: int(math.Round(float64(position.y) * factor)),
+	}
+}
+
+func (position Position) dot(other Position) int {
+	return position.x*other.x + position.y*other.y
+}
+
+// length The position as a vector from 0,0
+func (position Position) length() float64 {
+	return math.Sqrt(float64(position.dot(position)))
+}
+
+// normalize The same direction, with the given length. 0,0 stays 0,0.
+func (position Position) normalize(length float64) Position {
+	current := position.length()
+	if current == 0 {
+		return position
+	}
+	return position.scale(length / current)
+}
+
+// lerp The position at t (0 to 1) on the way to the target
+func (position Position) lerp(target Position, t float64) Position {
+	return position.add(target.subtract(position).scale(t))
+}
+
+func (position Position) distanceTo(other Position) float64 {
+	return distanceBetween(position, other)
+}
+
+// distanceSquared Cheaper than distanceTo when only comparing
+func (position Position) distanceSquared(other Position) int {
+	difference := position.subtract(other)
+	return difference.dot(difference)
+}
+
+func (position Position) clampToField() Position {
+	if position.x < 0 {
+		position.x = 0
+	} else if position.x > FieldWidth {
+		position.x = FieldWidth
+	}
+	if position.y < 0 {
+		position.y = 0
+	} else if position.y > FieldHeight {
+		position.y = FieldHeight
+	}
+	return position
+}
+
+// towards The point at the distance from the position, in the direction of the target
+func (position Position) towards(target Position, distance float64) Position {
+	return position.add(target.subtract(position).normalize(distance))
+}
+
+// step Where a unit with the speed ends up after one turn of moving to the target
+func (position Position) step(target Position, speed int) Position {
+	if position.distanceTo(target) <= float64(speed) {
+		return target
+	}
+	return position.towards(target, float64(speed))
+}
+
+// stepsTo Where a unit with the speed is after each of the turns it moves to the target
+func (position Position) stepsTo(target Position, speed int, turns int) []Position {
+	steps := make([]Position, 0, turns)
+	for turn := 0; turn < turns; turn++ {
+		position = position.step(target, speed)
+		steps = append(steps, position)
+	}
+	return steps
+}
+
+// distanceToSegment Shortest distance from the position to the line between from and to
+func (position Position) distanceToSegment(from Position, to Position) float64 {
+	segment := to.subtract(from)
+	lengthSquared := segment.dot(segment)
+	if lengthSquared == 0 {
+		return position.distanceTo(from)
+	}
+	t := float64(position.subtract(from).dot(segment)) / float64(lengthSquared)
+	t = math.Max(0, math.Min(1, t))
+	closestX := float64(from.x) + t*float64(segment.x)
+	closestY := float64(from.y) + t*float64(segment.y)
+	return math.Hypot(closestX-float64(position.x), closestY-float64(position.y))
+}
+
+// segmentLengthInCircle How much of the line between from and to lies inside the circle
+func segmentLengthInCircle(from Position, to Position, center Position, radius float64) float64 {
+	segment := to.subtract(from)
+	length := segment.length()
+	if length == 0 {
+		return 0
+	}
+	// Distance along the segment to the point closest to the center, and half the chord around it
+	along := float64(center.subtract(from).dot(segment)) / length
+	distanceSquared := float64(center.distanceSquared(from)) - along*along
+	if distanceSquared >= radius*radius {
+		return 0
+	}
+	halfChord := math.Sqrt(radius*radius - distanceSquared)
+	start := math.Max(0, along-halfChord)
+	end := math.Min(length, along+halfChord)
+	return math.Max(0, end-start)
+}
+
+// isInCircle Is the position inside (or on) the circle?
+func (position Position) isInCircle(center Position, radius float64) bool {
+	return float64(position.distanceSquared(center)) <= radius*radius
+}
+
+// segmentIntersectsCircle Does the line between from and to pass through the circle?
+func segmentIntersectsCircle(from Position, to Position, center Position, radius float64) bool {
+	return center.distanceToSegment(from, to) <= radius
+}
+
 /************************************************
 Helper functions
 *************************************************/
@@ -664,6 +3686,129 @@ func getRealStructureType(structureType int, param2 int) int {
 	return structureType
 }
 
+func getUnitsPerTraining(unitType int) int {
+	switch unitType {
+	case Knight:
+		return KnightsPerTraining
+	case Archer:
+		return ArchersPerTraining
+	case Giant:
+		return GiantsPerTraining
+	}
+	return 0
+}
+
+func getUnitSpeed(unitType int) int {
+	switch unitType {
+	case Knight:
+		return KnightSpeed
+	case Archer:
+		return ArcherSpeed
+	case Giant:
+		return GiantSpeed
+	}
+	return QueenSpeed
+}
+
+func getUnitHealth(unitType int) int {
+	switch unitType {
+	case Knight:
+		return KnightHealth
+	case Archer:
+		return ArcherHealth
+	case Giant:
+		return GiantHealth
+	}
+	return 0
+}
+
+func isBarracks(structureType int) bool {
+	return structureType == Barracks || structureType == GiantBarracks || structureType == ArcherBarracks
+}
+
+// getUnitForBarracks The unit type the barracks trains
+func getUnitForBarracks(structureType int) int {
+	switch structureType {
+	case ArcherBarracks:
+		return Archer
+	case GiantBarracks:
+		return Giant
+	}
+	return Knight
+}
+
+// getBarracksForUnit The structure type that trains the unit type
+func getBarracksForUnit(unitType int) int {
+	switch unitType {
+	case Archer:
+		return ArcherBarracks
+	case Giant:
+		return GiantBarracks
+	}
+	return Barracks
+}
+
+func getTrainTurns(unitType int) int {
+	switch unitType {
+	case Knight:
+		return KnightTrainTurns
+	case Archer:
+		return ArcherTrainTurns
+	case Giant:
+		return GiantTrainTurns
+	}
+	return 0
+}
+
+func getOpponent(owner int) int {
+	if owner == Friendly {
+		return Enemy
+	}
+	return Friendly
+}
+
+// getTowerRange The attack radius of a Tower with the health, on a site with the radius
+func getTowerRange(health int, siteRadius int) int {
+	siteArea := math.Pi * float64(siteRadius*siteRadius)
+	return int(math.Sqrt((float64(health*TowerCoveragePerHP) + siteArea) / math.Pi))
+}
+
+func mirrorPosition(position Position) Position {
+	return Position{
+		x: FieldWidth,
+		y: FieldHeight,
+	}.subtract(position)
+}
+
+// getTurnsToTravel How many turns to cover the distance at the speed
+func getTurnsToTravel(distance float64, speed int) int {
+	if distance <= 0 {
+		return 0
+	}
+	return int(math.Ceil(distance / float64(speed)))
+}
+
+func absInt(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
 func distanceBetween(fromPosition Position, targetPosition Position) float64 {
 	return math.Sqrt(math.Pow(float64(fromPosition.x-targetPosition.x), 2) + math.Pow(float64(fromPosition.y-targetPosition.y), 2))
 }
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+type testSite struct {
+	ID, x, y, radius                                         int
+	goldRemaining, maxMineSize, structureType, owner, p1, p2 int
+}
+
+type testUnit struct {
+	x, y, owner, unitType, health int
+}
+
+type testTurn struct {
+	gold, touchedSite int
+	sites             []testSite
+	units             []testUnit
+}
+
+var testSites = []testSite{
+	{0, 120, 180, 80, 200, 2, -1, -1, -1, -1},
+	{1, 320, 420, 70, 200, 2, -1, -1, -1, -1},
+	{2, 160, 760, 75, 200, 2, -1, -1, -1, -1},
+	{3, 480, 130, 65, 200, 2, -1, -1, -1, -1},
+	{4, 560, 640, 80, 200, 2, -1, -1, -1, -1},
+	{5, 760, 360, 70, 200, 2, -1, -1, -1, -1},
+	{6, 1800, 820, 80, 200, 2, -1, -1, -1, -1},
+	{7, 1600, 580, 70, 200, 2, -1, -1, -1, -1},
+	{8, 1760, 240, 75, 200, 2, -1, -1, -1, -1},
+	{9, 1440, 870, 65, 200, 2, -1, -1, -1, -1},
+	{10, 1360, 360, 80, 200, 2, -1, -1, -1, -1},
+	{11, 1160, 640, 70, 200, 2, -1, -1, -1, -1},
+}
+
+// mirrorTurn The same turn, played from the other side of the field
+func mirrorTurn(turn testTurn) testTurn {
+	mirrored := testTurn{gold: turn.gold, touchedSite: turn.touchedSite}
+	for _, site := range turn.sites {
+		position := mirrorPosition(Position{x: site.x, y: site.y})
+		site.x, site.y = position.x, position.y
+		mirrored.sites = append(mirrored.sites, site)
+	}
+	for _, unit := range turn.units {
+		position := mirrorPosition(Position{x: unit.x, y: unit.y})
+		unit.x, unit.y = position.x, position.y
+		mirrored.units = append(mirrored.units, unit)
+	}
+	return mirrored
+}
+
+func writeInput(turns []testTurn) string {
+	var input strings.Builder
+	fmt.Fprintln(&input, len(turns[0].sites))
+	for _, site := range turns[0].sites {
+		fmt.Fprintln(&input, site.ID, site.x, site.y, site.radius)
+	}
+	for _, turn := range turns {
+		fmt.Fprintln(&input, turn.gold, turn.touchedSite)
+		for _, site := range turn.sites {
+			fmt.Fprintln(&input, site.ID, site.goldRemaining, site.maxMineSize, site.structureType, site.owner, site.p1, site.p2)
+		}
+		fmt.Fprintln(&input, len(turn.units))
+		for _, unit := range turn.units {
+			fmt.Fprintln(&input, unit.x, unit.y, unit.owner, unit.unitType, unit.health)
+		}
+	}
+	return input.String()
+}
+
+// playInput Plays the turns from the game's input text, returns the queen and train action of every turn.
+// A panic fails the test, instead of turning into a WAIT like playTurn does.
+func playInput(turns []testTurn) []string {
+	actions := []string{}
+	game := newGame()
+	game.input = strings.NewReader(writeInput(turns))
+	game.readSites()
+	for range turns {
+		game.readTurn()
+		queenAction, trainAction := game.decideTurn()
+		actions = append(actions, queenAction, trainAction)
+		game.turn++
+	}
+	return actions
+}
+
+func TestMirroredInputMirrorsActions(t *testing.T) {
+	opening := testTurn{
+		gold:        100,
+		touchedSite: -1,
+		sites:       testSites,
+		units: []testUnit{
+			{200, 500, Friendly, Queen, 200},
+			{1720, 500, Enemy, Queen, 200},
+		},
+	}
+	building := opening
+	building.touchedSite = 1
+	building.units = []testUnit{
+		{320, 420, Friendly, Queen, 200},
+		{1600, 580, Enemy, Queen, 200},
+	}
+	knightsIncoming := building
+	knightsIncoming.units = append([]testUnit{}, building.units...)
+	knightsIncoming.units = append(knightsIncoming.units,
+		testUnit{620, 430, Enemy, Knight, 25},
+		testUnit{640, 400, Enemy, Knight, 25},
+		testUnit{650, 440, Enemy, Knight, 25},
+	)
+
+	tests := []struct {
+		name  string
+		turns []testTurn
+	}{
+		{"opening", []testTurn{opening}},
+		{"touching a site", []testTurn{opening, building}},
+		{"knights incoming", []testTurn{opening, knightsIncoming}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mirroredTurns := []testTurn{}
+			for _, turn := range test.turns {
+				mirroredTurns = append(mirroredTurns, mirrorTurn(turn))
+			}
+			actions := playInput(test.turns)
+			mirroredActions := playInput(mirroredTurns)
+			for i := range actions {
+				if mirrorAction(actions[i]) != mirroredActions[i] {
+					t.Errorf("action %d: %q, mirrored %q, expected %q", i, actions[i], mirroredActions[i], mirrorAction(actions[i]))
+				}
+			}
+		})
+	}
+}
+
+// scriptedGame Queens walking to their first sites, a mine and barracks going up, and Knights coming over
+func scriptedGame(turns int) []testTurn {
+	game := []testTurn{}
+	for turn := 0; turn < turns; turn++ {
+		myQueen := Position{200, 500}.step(Position{320, 420}, QueenSpeed*turn)
+		enemyQueen := Position{1720, 500}.step(Position{1600, 580}, QueenSpeed*turn)
+		current := testTurn{
+			gold:        100 + 20*turn,
+			touchedSite: -1,
+			sites:       append([]testSite{}, testSites...),
+			units: []testUnit{
+				{myQueen.x, myQueen.y, Friendly, Queen, 200},
+				{enemyQueen.x, enemyQueen.y, Enemy, Queen, 200},
+			},
+		}
+		if turn >= 3 {
+			current.touchedSite = 1
+			current.sites[1] = testSite{1, 320, 420, 70, 190, 2, Goldmine, Friendly, 1, -1}
+			current.sites[7] = testSite{7, 1600, 580, 70, 200, 2, Barracks, Enemy, 0, Knight}
+		}
+		if turn >= 5 {
+			current.sites[0] = testSite{0, 120, 180, 80, 190, 2, Goldmine, Friendly, 1, -1}
+		}
+		if turn >= 7 {
+			current.sites[4] = testSite{4, 560, 640, 80, 200, 2, Barracks, Friendly, 0, Knight}
+		}
+		// A wave of Knights every 6 turns, from turn 5
+		for wave := 5; wave <= turn; wave += 6 {
+			for i := 0; i < KnightsPerTraining; i++ {
+				knight := Position{1500, 560 + 20*i}.step(myQueen, KnightSpeed*(turn-wave))
+				current.units = append(current.units, testUnit{knight.x, knight.y, Enemy, Knight, 25 - (turn - wave)})
+			}
+		}
+		game = append(game, current)
+	}
+	return game
+}
+
+func TestSnapshotReplaysTurn(t *testing.T) {
+	turns := scriptedGame(20)
+	game := newGame()
+	game.input = strings.NewReader(writeInput(turns))
+	game.readSites()
+	for range turns {
+		game.readTurn()
+		snapshot := game.snapshot()
+		loaded, err := loadGame([]byte(snapshot.toJSON()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loaded.snapshot().toJSON() != snapshot.toJSON() {
+			t.Errorf("turn %d: loaded %s, expected %s", game.turn, loaded.snapshot().toJSON(), snapshot.toJSON())
+		}
+		replayedQueenAction, replayedTrainAction := loaded.decideTurn()
+		queenAction, trainAction := game.decideTurn()
+		if replayedQueenAction != queenAction || replayedTrainAction != trainAction {
+			t.Errorf("turn %d: played %q %q, replayed %q %q", game.turn, queenAction, trainAction, replayedQueenAction, replayedTrainAction)
+		}
+		game.turn++
+	}
+}
+
+func TestPuzzles(t *testing.T) {
+	if !runPuzzles("puzzles") {
+		t.Error("puzzles failed, see the FAIL lines above")
+	}
+}